@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Processes a request from the UI, returning an error if it was rejected
+type processor func(r *http.Request) error
+
+// Error returned to clients as JSON with an HTTP status code
+type apiError struct {
+	Status  int    `json:"status"`
+	Message string `json:"error"`
+}
+
+func (e apiError) Error() string {
+	return e.Message
+}
+
+func newError(status int, format string, a ...interface{}) error {
+	return apiError{Status: status, Message: fmt.Sprintf(format, a...)}
+}
+
+func badRequest(format string, a ...interface{}) error {
+	return newError(http.StatusBadRequest, format, a...)
+}
+
+// Send error to client, errors other than apiError are internal
+func writeError(w http.ResponseWriter, err error) {
+	e, ok := err.(apiError)
+	if !ok {
+		e = apiError{Status: http.StatusInternalServerError, Message: err.Error()}
+	}
+	log.Printf("Request failed with %v: %v", e.Status, e.Message)
+	body, _ := json.Marshal(e)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.Status)
+	fmt.Fprint(w, string(body))
+}
+
+// Only allow POST requests
+func post(process processor) processor {
+	return func(r *http.Request) error {
+		if r.Method != http.MethodPost {
+			return newError(http.StatusMethodNotAllowed, "%v not allowed, use POST", r.Method)
+		}
+		return process(r)
+	}
+}
+
+func decode(r *http.Request, v interface{}) error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		return badRequest("invalid request: %v", err)
+	}
+	return nil
+}
+
+func knownNamespace(ns string, s state) error {
+	if _, ok := s.getStateFor(ns); !ok {
+		return newError(http.StatusNotFound, "unknown namespace '%v'", ns)
+	}
+	return nil
+}
+
+func validateLimit(limit resource.Quantity, spec Specification) error {
+	min, max := gibibytes(spec.MinMemLimit), gibibytes(spec.MaxMemLimit)
+	if limit.Cmp(min) < 0 || limit.Cmp(max) > 0 {
+		return badRequest("memory limit must be from %vGi to %vGi", spec.MinMemLimit, spec.MaxMemLimit)
+	}
+	return nil
+}
+
+func validateMemLimits(cfg nsConfig, spec Specification) error {
+	if cfg.MemLimitRatio != nil && *cfg.MemLimitRatio != 0 && *cfg.MemLimitRatio < 1 {
+		return badRequest("memory limit ratio must be at least 1, or 0 for no limits quota")
+	}
+	if limits := memLimitsQuota(cfg, spec); limits != nil && limits.Cmp(*memLimit(cfg)) < 0 {
+		return badRequest("memory limits quota %v is less than the requests quota %v", limits, memLimit(cfg))
+	}
+	return nil
+}
+
+func validateStartHour(hour *int) error {
+	if hour != nil && (*hour < 0 || *hour > 23) {
+		return badRequest("start hour must be from 0 to 23")
+	}
+	return nil
+}
+
+func validateCPU(request int, limit int) error {
+	if request < 0 || limit < 0 {
+		return badRequest("cpu request and limit can't be negative")
+	}
+	if request > 0 && limit > 0 && request > limit {
+		return badRequest("cpu request can't be more than the limit")
+	}
+	return nil
+}
+
+func validateStorage(storage *storageConfig) error {
+	if storage == nil {
+		return nil
+	}
+	if storage.Claims < 0 || (storage.Requests != nil && storage.Requests.Sign() < 0) {
+		return badRequest("storage quota can't be negative")
+	}
+	for class, value := range storage.Classes {
+		if class == "" {
+			return badRequest("storage class name is required")
+		}
+		if value.Sign() < 0 {
+			return badRequest("storage quota for %v can't be negative", class)
+		}
+	}
+	return nil
+}
+
+func validatePolicy(policy *extendPolicy) error {
+	if policy == nil {
+		return nil
+	}
+	if (policy.MinSinceStart != nil && *policy.MinSinceStart < 0) ||
+		(policy.MaxRemaining != nil && *policy.MaxRemaining < 0) ||
+		(policy.MaxPerDay != nil && *policy.MaxPerDay < 0) {
+		return badRequest("extend policy values can't be negative")
+	}
+	return nil
+}
+
+// Limit range can only have memory and cpu values, which must be
+// ordered min <= default request <= default <= max
+func validateLimitRange(lr *limitRangeConfig, cfg nsConfig) error {
+	if lr == nil {
+		return nil
+	}
+	for _, list := range []v1.ResourceList{lr.DefaultRequest, lr.Default, lr.Min, lr.Max} {
+		for name, value := range list {
+			if name != v1.ResourceMemory && name != v1.ResourceCPU {
+				return badRequest("unsupported limit range resource '%v'", name)
+			}
+			if value.Sign() < 0 {
+				return badRequest("limit range %v can't be negative", name)
+			}
+		}
+	}
+	cfg.LimitRange = lr
+	item := limitRangeFor(cfg)
+	ordered := []v1.ResourceList{item.Min, item.DefaultRequest, item.Default, item.Max}
+	for _, name := range []v1.ResourceName{v1.ResourceMemory, v1.ResourceCPU} {
+		var previous *resource.Quantity
+		for _, list := range ordered {
+			value, ok := list[name]
+			if !ok {
+				continue
+			}
+			if previous != nil && previous.Cmp(value) > 0 {
+				return badRequest("limit range %v values must be min <= default request <= default <= max", name)
+			}
+			previous = &value
+		}
+	}
+	return nil
+}
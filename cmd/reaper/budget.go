@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Periodically update the cluster memory budget, either from config
+// or from the allocatable memory of the nodes
+func maintainBudget(ctx context.Context, s state) {
+	update := func() {
+		if s.Spec.MemBudget > 0 {
+			s.updateBudget <- int64(s.Spec.MemBudget) * bytesInGi
+			return
+		}
+		allocatable, err := s.cluster.getAllocatableMemory(ctx)
+		if err != nil {
+			log.Printf("Unable to get allocatable memory: %v", err)
+			return
+		}
+		s.updateBudget <- allocatable
+	}
+	update() // don't wait for first tick
+	tick := time.NewTicker(s.Spec.BudgetTick)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			update()
+		}
+	}
+}
+
+// Sum of memory limits of running namespaces, apart from the excluded one
+func usedBudget(configs map[string]nsConfig, states map[string]nsState, exclude string) int64 {
+	used := int64(0)
+	for name, state := range states {
+		cfg, ok := configs[name]
+		if !ok {
+			cfg = nsConfig{Name: name, Limit: defaultLimit}
+		}
+		if name != exclude && currentPhase(cfg, state) == phaseRunning {
+			used += memLimit(cfg).Value()
+		}
+	}
+	return used
+}
+
+func newBudget(total int64, used int64) memBudget {
+	return memBudget{
+		Total:     newMemAmount(total),
+		Used:      newMemAmount(used),
+		Available: newMemAmount(max(total-used, 0)),
+	}
+}
+
+// Check there's enough budget for the limit of a changed namespace config
+// if the namespace is running, decreasing a limit is always allowed
+func fitsBudget(cfg nsConfig, configs map[string]nsConfig, states map[string]nsState, total int64) error {
+	if total <= 0 {
+		return nil // budget not known yet
+	}
+	current, ok := configs[cfg.Name]
+	if !ok {
+		current = nsConfig{Name: cfg.Name, Limit: defaultLimit}
+	}
+	limit := memLimit(cfg).Value()
+	if limit <= memLimit(current).Value() || currentPhase(current, states[cfg.Name]) != phaseRunning {
+		return nil
+	}
+	budget := newBudget(total, usedBudget(configs, states, cfg.Name))
+	if limit > budget.Available.Bytes {
+		return newError(http.StatusConflict, "not enough memory in cluster budget, %v of %v available",
+			budget.Available.Formatted, budget.Total.Formatted)
+	}
+	return nil
+}
+
+// Check a declared memory limit fits in the budget like a limit set in the
+// UI, dropping it from the declared settings if it doesn't
+func checkDeclaredBudget(ns string, declared *declaredConfig, s state) error {
+	if declared.Memory == nil {
+		return nil
+	}
+	result := make(chan error, 1)
+	s.updateDeclared <- declaredUpdate{name: ns, declared: *declared, result: result}
+	if err := <-result; err != nil {
+		declared.Memory = nil
+		return fmt.Errorf("%v: %v", memoryLimitAnnotation, err)
+	}
+	return nil
+}
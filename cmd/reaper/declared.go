@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// where a namespace setting came from
+const sourceDefault = "default"
+const sourceUI = "ui"
+const sourceAnnotation = "annotation"
+
+// which source wins when a setting is both annotated and set in the UI
+const precedenceAnnotations = "annotations"
+const precedenceUI = "ui"
+
+// Settings declared by annotations on the namespace, nil if not annotated
+type declaredConfig struct {
+	StartHour *int
+	Memory    *resource.Quantity
+	Window    *time.Duration
+	Override  bool // annotations take precedence over the UI
+}
+
+// Read the settings declared by a namespace's annotations, invalid values
+// are reported and ignored
+func declared(ns *v1.Namespace, spec Specification) (declaredConfig, []error) {
+	result := declaredConfig{Override: spec.AnnotationPrecedence == precedenceAnnotations}
+	errs := []error{}
+	if value, ok := ns.Annotations[startHourAnnotation]; ok {
+		hour, err := strconv.Atoi(value)
+		if err == nil {
+			err = validateStartHour(&hour)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%v: %v", startHourAnnotation, err))
+		} else {
+			result.StartHour = &hour
+		}
+	}
+	if value, ok := ns.Annotations[memoryLimitAnnotation]; ok {
+		memory, err := resource.ParseQuantity(value)
+		if err == nil {
+			err = validateLimit(memory, spec)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%v: %v", memoryLimitAnnotation, err))
+		} else {
+			result.Memory = &memory
+		}
+	}
+	if value, ok := ns.Annotations[windowAnnotation]; ok {
+		window, err := time.ParseDuration(value)
+		if err == nil && (window < time.Minute || window > 24*time.Hour) {
+			err = fmt.Errorf("window must be from 1m to 24h")
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%v: %v", windowAnnotation, err))
+		} else {
+			result.Window = &window
+		}
+	}
+	return result, errs
+}
+
+// Whether a namespace has any declared settings
+func (d declaredConfig) any() bool {
+	return d.StartHour != nil || d.Memory != nil || d.Window != nil
+}
+
+// Add the declared settings of each namespace to its config, namespaces
+// with declared settings but no config get the defaults
+func withDeclared(configs map[string]nsConfig, states map[string]nsState) map[string]nsConfig {
+	result := map[string]nsConfig{}
+	for name, cfg := range configs {
+		cfg.Declared = nil
+		result[name] = cfg
+	}
+	for name, state := range states {
+		if !state.Declared.any() {
+			continue
+		}
+		cfg, ok := result[name]
+		if !ok {
+			cfg = nsConfig{Name: name, Limit: defaultLimit}
+		}
+		declared := state.Declared
+		cfg.Declared = &declared
+		result[name] = cfg
+	}
+	return result
+}
+
+// The auto start hour of a namespace and where it came from
+func startHour(cfg nsConfig) (*int, string) {
+	d := cfg.Declared
+	if d != nil && d.StartHour != nil && (d.Override || cfg.AutoStartHour == nil) {
+		return d.StartHour, sourceAnnotation
+	}
+	if cfg.AutoStartHour != nil {
+		return cfg.AutoStartHour, sourceUI
+	}
+	return nil, sourceDefault
+}
+
+// Where the memory limit of a namespace came from, see memLimit
+func memLimitSource(cfg nsConfig) string {
+	d := cfg.Declared
+	if d != nil && d.Memory != nil && (d.Override || cfg.Memory == nil) {
+		return sourceAnnotation
+	}
+	if cfg.Memory != nil {
+		return sourceUI
+	}
+	return sourceDefault
+}
+
+// The uptime window of a namespace in seconds, only set by annotation
+func windowOf(cfg nsConfig) int64 {
+	if cfg.Declared != nil && cfg.Declared.Window != nil {
+		return int64(cfg.Declared.Window.Seconds())
+	}
+	return window * 60 * 60
+}
+
+func windowSource(cfg nsConfig) string {
+	if cfg.Declared != nil && cfg.Declared.Window != nil {
+		return sourceAnnotation
+	}
+	return sourceDefault
+}
+
+// The source of each setting that can be declared, for the UI
+func sources(cfg nsConfig) map[string]string {
+	_, hourSource := startHour(cfg)
+	return map[string]string{
+		"startHour":   hourSource,
+		"memoryLimit": memLimitSource(cfg),
+		"window":      windowSource(cfg),
+	}
+}
+
+// Reject UI changes to settings that are overridden by an annotation
+func checkDeclared(cfg nsConfig, setting string) error {
+	if cfg.Declared == nil || !cfg.Declared.Override || sources(cfg)[setting] != sourceAnnotation {
+		return nil
+	}
+	return newError(http.StatusConflict, "%v of %v is set by a namespace annotation", setting, cfg.Name)
+}
+
+// Reject changes to several settings at once, e.g. by an import, that change
+// any setting overridden by an annotation
+func checkDeclaredChanges(current nsConfig, updated nsConfig) error {
+	if !sameJSON(current.AutoStartHour, updated.AutoStartHour) {
+		if err := checkDeclared(current, "startHour"); err != nil {
+			return err
+		}
+	}
+	ui := func(cfg nsConfig) string {
+		cfg.Declared = nil
+		return memLimit(cfg).String()
+	}
+	if ui(current) != ui(updated) {
+		return checkDeclared(current, "memoryLimit")
+	}
+	return nil
+}
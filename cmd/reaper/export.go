@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+
+	"sigs.k8s.io/yaml"
+)
+
+// how an imported document is applied
+const importMerge = "merge"     // only change the namespaces in the document
+const importReplace = "replace" // also reset namespaces not in the document
+
+// The settings of all namespaces, sorted by name, as JSON or YAML. Configs
+// kept for deleted namespaces aren't included.
+func exportConfigs(cfgs []nsConfig, asYAML bool) ([]byte, error) {
+	settings := []nsConfig{}
+	for _, cfg := range cfgs {
+		if cfg.Deleted == 0 {
+			settings = append(settings, settingsOf(cfg))
+		}
+	}
+	sort.Slice(settings, func(i, j int) bool { return settings[i].Name < settings[j].Name })
+	if asYAML {
+		return yaml.Marshal(settings)
+	}
+	return json.Marshal(settings)
+}
+
+// Read an exported document, JSON being a subset of YAML. Entries without
+// a memory limit get the default one.
+func parseConfigs(data []byte) ([]nsConfig, error) {
+	cfgs := []nsConfig{}
+	if err := yaml.UnmarshalStrict(data, &cfgs); err != nil {
+		return nil, badRequest("invalid config: %v", err)
+	}
+	for i, cfg := range cfgs {
+		if cfg.Limit == 0 && cfg.Memory == nil {
+			cfgs[i].Limit = defaultLimit
+		}
+	}
+	return cfgs, nil
+}
+
+// Check every entry of an imported document, as the UI checks each change
+func validateConfigs(cfgs []nsConfig, spec Specification) error {
+	names := map[string]bool{}
+	for _, cfg := range cfgs {
+		if cfg.Name == "" {
+			return badRequest("namespace name is required")
+		}
+		if names[cfg.Name] {
+			return badRequest("namespace %v is in the config more than once", cfg.Name)
+		}
+		names[cfg.Name] = true
+		for _, err := range []error{
+			validateStartHour(cfg.AutoStartHour),
+			validateLimit(*memLimit(cfg), spec),
+			validateMemLimits(cfg, spec),
+			validateCPU(cfg.CPURequest, cfg.CPULimit),
+			validateStorage(cfg.Storage),
+			validatePolicy(cfg.ExtendPolicy),
+			validateLimitRange(cfg.LimitRange, cfg),
+		} {
+			if err != nil {
+				return badRequest("%v: %v", cfg.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// The changes needed to import the settings, keeping the state of existing
+// namespaces. Entries for namespaces that don't exist yet are kept so they
+// apply once the namespace is created.
+func planImport(current map[string]nsConfig, imported []nsConfig, mode string) []configChange {
+	changes := []configChange{}
+	add := func(name string, action string, after nsConfig) {
+		before, ok := current[name]
+		if !ok {
+			before = nsConfig{Name: name, Limit: defaultLimit}
+		}
+		after = restored(before, after)
+		if sameJSON(settingsOf(before), settingsOf(after)) {
+			return
+		}
+		change := configChange{Namespace: name, Action: action, After: settingsOf(after)}
+		if ok {
+			old := settingsOf(before)
+			change.Before = &old
+		}
+		changes = append(changes, change)
+	}
+	names := map[string]bool{}
+	for _, cfg := range imported {
+		names[cfg.Name] = true
+		action := "update"
+		if _, ok := current[cfg.Name]; !ok {
+			action = "add"
+		}
+		add(cfg.Name, action, cfg)
+	}
+	if mode == importReplace {
+		for name, cfg := range current {
+			// configs kept for deleted namespaces aren't exported
+			if !names[name] && cfg.Deleted == 0 {
+				add(name, "reset", nsConfig{Name: name, Limit: defaultLimit})
+			}
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Namespace < changes[j].Namespace })
+	return changes
+}
+
+// The config of a namespace with imported settings, keeping its state. An
+// entry for a deleted namespace is no longer a kept config that expires, it
+// applies once the namespace is created like any other entry.
+func importedConfig(current nsConfig, settings nsConfig) nsConfig {
+	cfg := restored(current, settings)
+	cfg.Deleted = 0
+	return cfg
+}
+
+// Make the changes of an import as if each was made in the UI: settings set
+// by annotations can't be changed, and the memory limits have to fit in the
+// budget together. Nothing is changed if any of them are rejected.
+func importChanges(changes []configChange, dryRun bool, s state) error {
+	updated := []nsConfig{}
+	for _, change := range changes {
+		current := s.getConfigFor(change.Namespace)
+		cfg := importedConfig(current, change.After)
+		if err := checkDeclaredChanges(current, cfg); err != nil {
+			return err
+		}
+		updated = append(updated, cfg)
+	}
+	if dryRun {
+		return nil
+	}
+	return s.updateWithinBudget(updated...)
+}
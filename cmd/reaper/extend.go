@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Default extend policy from the environment
+func defaultPolicy(spec Specification) extendPolicy {
+	minSinceStart := int64(spec.ExtendMinSinceStart.Seconds())
+	maxRemaining := int64(spec.ExtendMaxRemaining.Seconds())
+	return extendPolicy{
+		MinSinceStart: &minSinceStart,
+		MaxRemaining:  &maxRemaining,
+		MaxPerDay:     &spec.ExtendMaxPerDay,
+		AllowStopped:  &spec.ExtendStopped,
+	}
+}
+
+// Policy for a namespace, values not overridden come from the defaults
+func policyFor(cfg nsConfig, spec Specification) extendPolicy {
+	policy := defaultPolicy(spec)
+	override := cfg.ExtendPolicy
+	if override == nil {
+		return policy
+	}
+	if override.MinSinceStart != nil {
+		policy.MinSinceStart = override.MinSinceStart
+	}
+	if override.MaxRemaining != nil {
+		policy.MaxRemaining = override.MaxRemaining
+	}
+	if override.MaxPerDay != nil {
+		policy.MaxPerDay = override.MaxPerDay
+	}
+	if override.AllowStopped != nil {
+		policy.AllowStopped = override.AllowStopped
+	}
+	return policy
+}
+
+// Check whether the namespace can be extended (or started if it's stopped),
+// returns the reason if not. The time rules don't apply in the warning period.
+func checkExtend(policy extendPolicy, cfg nsConfig, state nsState, now time.Time) error {
+	if *policy.MaxPerDay > 0 && cfg.ExtendDay == day(now) && cfg.Extends >= *policy.MaxPerDay {
+		return fmt.Errorf("already extended %v times today", cfg.Extends)
+	}
+	if currentPhase(cfg, state) != phaseRunning {
+		if !*policy.AllowStopped {
+			return fmt.Errorf("stopped namespaces can't be extended")
+		}
+		return nil
+	}
+	if state.StoppingSoon {
+		return nil
+	}
+	started := max(cfg.LastStarted, state.LastScheduled)
+	if now.Unix()-started < *policy.MinSinceStart {
+		return fmt.Errorf("started less than %v ago", duration(*policy.MinSinceStart))
+	}
+	seconds := remainingSeconds(started, now.Unix(), windowOf(cfg))
+	if *policy.MaxRemaining > 0 && seconds > *policy.MaxRemaining {
+		return fmt.Errorf("more than %v remaining", duration(*policy.MaxRemaining))
+	}
+	return nil
+}
+
+// Count the extends for the current day
+func recordExtend(cfg nsConfig, now time.Time) nsConfig {
+	today := day(now)
+	if cfg.ExtendDay != today {
+		cfg.ExtendDay = today
+		cfg.Extends = 0
+	}
+	cfg.Extends++
+	return cfg
+}
+
+func day(t time.Time) string {
+	return t.Format("2006-01-02")
+}
+
+func duration(seconds int64) time.Duration {
+	return time.Duration(seconds) * time.Second
+}
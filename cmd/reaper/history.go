@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Bounded history of the namespace settings, kept in a ConfigMap next to
+// the configs whichever store they're saved in
+type configHistory struct {
+	cluster  k8s
+	location types.NamespacedName
+	size     int // revisions kept, zero to keep none
+}
+
+func newConfigHistory(spec Specification, cluster k8s) configHistory {
+	location := configMapLocation(spec)
+	location.Name += "-history"
+	return configHistory{cluster: cluster, location: location, size: spec.HistorySize}
+}
+
+// Revisions from oldest to newest, empty if none have been recorded
+func (h configHistory) load(ctx context.Context) ([]revision, error) {
+	result := []revision{}
+	cm, err := h.cluster.getConfigMap(ctx, h.location)
+	if errors.IsNotFound(err) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(cm.Data["history"]), &result)
+	return result, err
+}
+
+// Record the settings as a new revision if they changed since the last one,
+// dropping the oldest revisions when there are too many
+func (h configHistory) record(ctx context.Context, cfgs []nsConfig, now time.Time) error {
+	if h.size <= 0 {
+		return nil
+	}
+	history, err := h.load(ctx)
+	if err != nil {
+		return err
+	}
+	settings := []nsConfig{}
+	for _, cfg := range cfgs {
+		settings = append(settings, settingsOf(cfg))
+	}
+	sort.Slice(settings, func(i, j int) bool { return settings[i].Name < settings[j].Name })
+	next := 1
+	if len(history) > 0 {
+		latest := history[len(history)-1]
+		if sameJSON(latest.Configs, settings) {
+			return nil
+		}
+		next = latest.Revision + 1
+	}
+	history = append(history, revision{Revision: next, Time: formatTime(now.Unix(), time.UTC), Configs: settings})
+	if len(history) > h.size {
+		history = history[len(history)-h.size:]
+	}
+	data, err := json.Marshal(history)
+	if err != nil {
+		return err
+	}
+	return h.cluster.saveConfigMapData(ctx, h.location, map[string]string{"history": string(data)})
+}
+
+func findRevision(history []revision, number int) (revision, bool) {
+	for _, r := range history {
+		if r.Revision == number {
+			return r, true
+		}
+	}
+	return revision{}, false
+}
+
+// The settings of a namespace in a revision, the defaults if it had none
+func (r revision) configFor(ns string) nsConfig {
+	for _, cfg := range r.Configs {
+		if cfg.Name == ns {
+			return cfg
+		}
+	}
+	return nsConfig{Name: ns, Limit: defaultLimit}
+}
+
+// Roll back the settings of namespaces to a revision as if each was changed
+// in the UI: settings set by annotations can't be changed, and the memory
+// limits have to fit in the budget together. Nothing is changed if any of
+// them are rejected.
+func rollback(namespaces []string, rev revision, s state) error {
+	updated := []nsConfig{}
+	for _, ns := range namespaces {
+		current := s.getConfigFor(ns)
+		cfg := restored(current, rev.configFor(ns))
+		if err := checkDeclaredChanges(current, cfg); err != nil {
+			return err
+		}
+		updated = append(updated, cfg)
+	}
+	return s.updateWithinBudget(updated...)
+}
+
+// The settings of a config, without the state kept by the reaper
+func settingsOf(cfg nsConfig) nsConfig {
+	cfg.LastStarted, cfg.LastStopped = 0, 0
+	cfg.Phase, cfg.PhaseChanged = "", 0
+	cfg.ExtendDay, cfg.Extends = "", 0
+	cfg.Deleted = 0
+	cfg.Declared = nil
+	return cfg
+}
+
+// Restore the settings from a revision, keeping the current state
+func restored(current nsConfig, settings nsConfig) nsConfig {
+	settings.Name = current.Name
+	settings.LastStarted, settings.LastStopped = current.LastStarted, current.LastStopped
+	settings.Phase, settings.PhaseChanged = current.Phase, current.PhaseChanged
+	settings.ExtendDay, settings.Extends = current.ExtendDay, current.Extends
+	settings.Deleted = current.Deleted
+	settings.Declared = current.Declared
+	return settings
+}
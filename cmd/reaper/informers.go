@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// Caches of the cluster resources the reaper watches
+type listers struct {
+	namespaces  corelisters.NamespaceLister
+	quotas      corelisters.ResourceQuotaLister
+	limitRanges corelisters.LimitRangeLister
+	pods        corelisters.PodLister
+	claims      corelisters.PersistentVolumeClaimLister
+}
+
+// Watch namespaces and the quotas, limit ranges, pods and claims in them
+// with shared informers. Reads of these come from the informer caches from
+// now on, and any change queues an update of its namespace. The resync
+// period makes sure every namespace is updated once in a while anyway.
+func (o *k8s) watch(ctx context.Context, resync time.Duration, changed workqueue.Interface) error {
+	factory := informers.NewSharedInformerFactory(o.clientset, resync)
+	core := factory.Core().V1()
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { queueNamespaceOf(obj, changed) },
+		UpdateFunc: func(_, obj interface{}) { queueNamespaceOf(obj, changed) },
+		DeleteFunc: func(obj interface{}) { queueNamespaceOf(obj, changed) },
+	}
+	for _, informer := range []cache.SharedIndexInformer{
+		core.Namespaces().Informer(),
+		core.ResourceQuotas().Informer(),
+		core.LimitRanges().Informer(),
+		core.Pods().Informer(),
+		core.PersistentVolumeClaims().Informer(),
+	} {
+		informer.AddEventHandler(handler)
+	}
+
+	factory.Start(ctx.Done())
+	for informer, synced := range factory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return fmt.Errorf("unable to sync %v cache", informer)
+		}
+	}
+	o.listers = &listers{
+		namespaces:  core.Namespaces().Lister(),
+		quotas:      core.ResourceQuotas().Lister(),
+		limitRanges: core.LimitRanges().Lister(),
+		pods:        core.Pods().Lister(),
+		claims:      core.PersistentVolumeClaims().Lister(),
+	}
+	return nil
+}
+
+// Queue the namespace of a changed object, or the namespace itself
+func queueNamespaceOf(obj interface{}, changed workqueue.Interface) {
+	if deleted, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = deleted.Obj
+	}
+	object, err := meta.Accessor(obj)
+	if err != nil {
+		log.Printf("Ignoring change to unknown object: %v", err)
+		return
+	}
+	if _, ok := obj.(*v1.Namespace); ok {
+		changed.Add(object.GetName())
+		return
+	}
+	changed.Add(object.GetNamespace())
+}
+
+// Update namespaces when anything in them changes
+func maintainNamespaces(ctx context.Context, s state) {
+	go func() {
+		<-ctx.Done()
+		s.changed.ShutDown()
+	}()
+	for {
+		item, shutdown := s.changed.Get()
+		if shutdown {
+			return
+		}
+		ns := item.(string)
+		if !contains(s.Spec.IgnoredNamespaces, ns) {
+			reconcile(ctx, ns, s)
+		}
+		s.changed.Done(item)
+	}
+}
+
+func reconcile(ctx context.Context, ns string, s state) {
+	err := updateNamespace(ctx, ns, s)
+	if err != nil {
+		log.Printf("Unable to update namespace %v: %v", ns, err)
+		// configs for namespaces that haven't been created yet are kept
+		if _, known := s.getStateFor(ns); known && !s.cluster.getExists(ctx, ns) {
+			log.Printf("Removing namespace: %v", ns)
+			s.rmNamespace <- ns
+		}
+	}
+}
@@ -5,88 +5,470 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"strconv"
+	"strings"
 
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	corev1apply "k8s.io/client-go/applyconfigurations/core/v1"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 )
 
 type k8s struct {
 	clientset kubernetes.Interface
+	dynamic   dynamic.Interface
+	listers   *listers // informer caches, nil if not watching
 }
 
-func (o *k8s) createNamespace(name string) {
+func (o *k8s) createNamespace(ctx context.Context, name string) {
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
 	nsSpec := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
-	o.clientset.CoreV1().Namespaces().Create(context.Background(), nsSpec, metav1.CreateOptions{})
+	o.clientset.CoreV1().Namespaces().Create(ctx, nsSpec, metav1.CreateOptions{})
 }
 
-func (o *k8s) getExists(namespace string) bool {
-	_, err := o.clientset.CoreV1().Namespaces().Get(context.Background(), namespace, metav1.GetOptions{})
+func (o *k8s) getNamespace(ctx context.Context, namespace string) (*v1.Namespace, error) {
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
+	if o.listers != nil {
+		return o.listers.namespaces.Get(namespace)
+	}
+	return o.clientset.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+}
+
+func (o *k8s) getExists(ctx context.Context, namespace string) bool {
+	_, err := o.getNamespace(ctx, namespace)
 	return err == nil
 }
 
-func (o *k8s) getStatusOf(namespace string) (string, error) {
-	ns, err := o.clientset.CoreV1().Namespaces().Get(context.Background(), namespace, metav1.GetOptions{})
+func (o *k8s) getStatusOf(ctx context.Context, namespace string) (string, error) {
+	ns, err := o.getNamespace(ctx, namespace)
 	if err != nil {
 		return "", err
 	}
 	return string(ns.Status.Phase), nil
 }
 
-func (o *k8s) getConfigMap(name string) (*v1.ConfigMap, error) {
-	return o.clientset.CoreV1().ConfigMaps("podreaper").
-		Get(context.Background(), name, metav1.GetOptions{})
+// Set an annotation on a namespace, or remove it if the value is empty
+func (o *k8s) annotateNamespace(ctx context.Context, namespace string, key string, value string) error {
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
+	ns, err := o.getNamespace(ctx, namespace)
+	if err != nil {
+		return err
+	}
+	if current, ok := ns.Annotations[key]; current == value && (ok || value == "") {
+		return nil // nothing to change
+	}
+	var patchValue interface{} // null removes the annotation
+	if value != "" {
+		patchValue = value
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{key: patchValue},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = o.clientset.CoreV1().Namespaces().Patch(ctx, namespace,
+		types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+func (o *k8s) getConfigMap(ctx context.Context, cm types.NamespacedName) (*v1.ConfigMap, error) {
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
+	return o.clientset.CoreV1().ConfigMaps(cm.Namespace).
+		Get(ctx, cm.Name, metav1.GetOptions{})
 }
 
-func (o *k8s) getSettings() ([]nsConfig, error) {
-	cm, err := o.getConfigMap(configMapName)
+// Set an annotation on a ConfigMap
+func (o *k8s) annotateConfigMap(ctx context.Context, cm types.NamespacedName, key string, value string) error {
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{key: value},
+		},
+	})
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return fromJSON(cm.Data["config"])
+	_, err = o.clientset.CoreV1().ConfigMaps(cm.Namespace).Patch(ctx, cm.Name,
+		types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
 }
 
-func (o *k8s) saveSettings(data []nsConfig) error {
+// Replace the data of a ConfigMap, creating it if needed
+func (o *k8s) saveConfigMapData(ctx context.Context, location types.NamespacedName, data map[string]string) error {
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: location.Name},
+		Data:       data,
+	}
+	cms := o.clientset.CoreV1().ConfigMaps(location.Namespace)
+	_, err := cms.Update(ctx, cm, metav1.UpdateOptions{})
+	if errors.IsNotFound(err) {
+		_, err = cms.Create(ctx, cm, metav1.CreateOptions{})
+	}
+	return err
+}
+
+// The saved settings and the resourceVersion of the ConfigMap they're in
+func (o *k8s) getSettings(ctx context.Context, location types.NamespacedName) ([]nsConfig, string, error) {
+	cm, err := o.getConfigMap(ctx, location)
+	if err != nil {
+		return nil, "", err
+	}
+	settings, err := fromJSON(cm.Data["config"])
+	return settings, cm.ResourceVersion, err
+}
+
+// Save settings over the given resourceVersion, or create the ConfigMap if
+// there isn't one yet, returning the new resourceVersion. Fails with a
+// conflict if the ConfigMap has been changed or created since.
+func (o *k8s) saveSettings(ctx context.Context, location types.NamespacedName, data []nsConfig, resourceVersion string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
 	jsonData, err := toJSON(data)
 	if err != nil {
-		return fmt.Errorf("unable to convert settings to JSON: %v", err)
+		return "", fmt.Errorf("unable to convert settings to JSON: %v", err)
 	}
 	cm := &v1.ConfigMap{
-		ObjectMeta: metav1.ObjectMeta{Name: configMapName},
+		ObjectMeta: metav1.ObjectMeta{Name: location.Name, ResourceVersion: resourceVersion},
 		Data:       map[string]string{"config": jsonData},
 	}
-	cms := o.clientset.CoreV1().ConfigMaps("podreaper")
-	_, err = cms.Update(context.Background(), cm, metav1.UpdateOptions{})
+	cms := o.clientset.CoreV1().ConfigMaps(location.Namespace)
+	if resourceVersion == "" {
+		cm, err = cms.Create(ctx, cm, metav1.CreateOptions{})
+		if errors.IsAlreadyExists(err) {
+			err = errors.NewConflict(v1.Resource("configmaps"), location.Name, err)
+		}
+	} else {
+		cm, err = cms.Update(ctx, cm, metav1.UpdateOptions{})
+	}
 	if err != nil {
-		_, err := cms.Create(context.Background(), cm, metav1.CreateOptions{})
+		return "", err
+	}
+	return cm.ResourceVersion, nil
+}
+
+func (o *k8s) deletePods(ctx context.Context, namespace string) error {
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
+	return o.clientset.CoreV1().Pods(namespace).DeleteCollection(ctx,
+		metav1.DeleteOptions{}, metav1.ListOptions{})
+}
+
+// Save the specs of bare pods that have opted in to being recreated, so they
+// can be restored when the namespace is started again
+func (o *k8s) snapshotBarePods(ctx context.Context, namespace string) error {
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
+	pods, err := o.clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to list pods: %v", err)
+	}
+	data := map[string]string{}
+	for _, pod := range pods.Items {
+		if !isRecreatable(pod) {
+			continue
+		}
+		podJSON, err := json.Marshal(strippedPod(pod))
+		if err != nil {
+			return fmt.Errorf("unable to convert pod %v to JSON: %v", pod.Name, err)
+		}
+		data[pod.Name] = string(podJSON)
+	}
+	cms := o.clientset.CoreV1().ConfigMaps(namespace)
+	if len(data) == 0 {
+		// a snapshot from an earlier stop has pods that are gone now
+		err := cms.Delete(ctx, podsConfigMapName, metav1.DeleteOptions{})
+		if errors.IsNotFound(err) {
+			return nil
+		}
 		return err
 	}
-	return nil
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   podsConfigMapName,
+			Labels: map[string]string{managedByLabel: managedBy},
+		},
+		Data: data,
+	}
+	_, err = cms.Update(ctx, cm, metav1.UpdateOptions{})
+	if errors.IsNotFound(err) {
+		_, err = cms.Create(ctx, cm, metav1.CreateOptions{})
+	}
+	return err
+}
+
+// Recreate pods saved by snapshotBarePods, then remove the snapshot
+func (o *k8s) restoreBarePods(ctx context.Context, namespace string) error {
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
+	cms := o.clientset.CoreV1().ConfigMaps(namespace)
+	cm, err := cms.Get(ctx, podsConfigMapName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil // nothing to restore
+	}
+	if err != nil {
+		return err
+	}
+	pods := o.clientset.CoreV1().Pods(namespace)
+	for name, podJSON := range cm.Data {
+		pod := &v1.Pod{}
+		if err := json.Unmarshal([]byte(podJSON), pod); err != nil {
+			log.Printf("Unable to read saved pod %v in %v: %v", name, namespace, err)
+			continue
+		}
+		_, err := pods.Create(ctx, pod, metav1.CreateOptions{})
+		if err != nil && !errors.IsAlreadyExists(err) {
+			log.Printf("Unable to recreate pod %v in %v: %v", name, namespace, err)
+			continue
+		}
+		log.Printf("Recreated pod %v in %v", name, namespace)
+	}
+	return cms.Delete(ctx, podsConfigMapName, metav1.DeleteOptions{})
 }
 
-func toJSON(settings []nsConfig) (string, error) {
-	result, err := json.Marshal(settings)
-	return string(result), err
+// Only running bare pods with the recreate annotation qualify
+func isRecreatable(pod v1.Pod) bool {
+	if len(pod.OwnerReferences) > 0 || pod.DeletionTimestamp != nil {
+		return false
+	}
+	if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+		return false
+	}
+	return pod.Annotations[recreateAnnotation] == "true"
 }
 
-func fromJSON(data string) ([]nsConfig, error) {
-	result := []nsConfig{}
-	err := json.Unmarshal([]byte(data), &result)
-	return result, err
+// Copy of a pod without status and the fields set when it was scheduled
+func strippedPod(pod v1.Pod) v1.Pod {
+	spec := *pod.Spec.DeepCopy()
+	spec.NodeName = ""
+	spec.EphemeralContainers = nil
+
+	// the service account token volume is injected again on creation
+	volumes := []v1.Volume{}
+	for _, vol := range spec.Volumes {
+		if !strings.HasPrefix(vol.Name, tokenVolumePrefix) {
+			volumes = append(volumes, vol)
+		}
+	}
+	spec.Volumes = volumes
+	spec.InitContainers = withoutTokenMounts(spec.InitContainers)
+	spec.Containers = withoutTokenMounts(spec.Containers)
+
+	return v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        pod.Name,
+			Labels:      pod.Labels,
+			Annotations: pod.Annotations,
+		},
+		Spec: spec,
+	}
 }
 
-func (o *k8s) deletePods(namespace string) error {
-	return o.clientset.CoreV1().Pods(namespace).DeleteCollection(context.Background(),
-		metav1.DeleteOptions{}, metav1.ListOptions{})
+func withoutTokenMounts(containers []v1.Container) []v1.Container {
+	for i, c := range containers {
+		mounts := []v1.VolumeMount{}
+		for _, m := range c.VolumeMounts {
+			if !strings.HasPrefix(m.Name, tokenVolumePrefix) {
+				mounts = append(mounts, m)
+			}
+		}
+		containers[i].VolumeMounts = mounts
+	}
+	return containers
 }
 
-func (o *k8s) getNamespaces() ([]string, error) {
-	nsList, err := o.clientset.CoreV1().Namespaces().List(context.Background(), metav1.ListOptions{})
+// Number of pods that haven't finished and aren't being deleted
+func (o *k8s) countRunningPods(ctx context.Context, namespace string) (int, error) {
+	pods, err := o.listPods(ctx, namespace)
 	if err != nil {
-		return nil, fmt.Errorf("unable to list namepsaces: %v", err)
+		return 0, fmt.Errorf("unable to list pods: %v", err)
+	}
+	count := 0
+	for _, pod := range pods {
+		finished := pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed
+		if !finished && pod.DeletionTimestamp == nil {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (o *k8s) listPods(ctx context.Context, namespace string) ([]*v1.Pod, error) {
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
+	if o.listers != nil {
+		return o.listers.pods.Pods(namespace).List(labels.Everything())
+	}
+	list, err := o.clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return pointers(list.Items), nil
+}
+
+// Scale deployments and stateful sets to zero and suspend cron jobs. The
+// original values are kept in annotations so they can be restored later.
+func (o *k8s) scaleDownWorkloads(ctx context.Context, namespace string) error {
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
+	apps := o.clientset.AppsV1()
+	deployments, err := apps.Deployments(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to list deployments: %v", err)
+	}
+	for _, d := range deployments.Items {
+		if scaledDown(&d.ObjectMeta, d.Spec.Replicas) {
+			d.Spec.Replicas = new(int32)
+			if _, err := apps.Deployments(namespace).Update(ctx, &d, metav1.UpdateOptions{}); err != nil {
+				return fmt.Errorf("unable to scale down deployment %v: %v", d.Name, err)
+			}
+		}
+	}
+	sets, err := apps.StatefulSets(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to list stateful sets: %v", err)
+	}
+	for _, ss := range sets.Items {
+		if scaledDown(&ss.ObjectMeta, ss.Spec.Replicas) {
+			ss.Spec.Replicas = new(int32)
+			if _, err := apps.StatefulSets(namespace).Update(ctx, &ss, metav1.UpdateOptions{}); err != nil {
+				return fmt.Errorf("unable to scale down stateful set %v: %v", ss.Name, err)
+			}
+		}
+	}
+	cronJobs := o.clientset.BatchV1().CronJobs(namespace)
+	jobs, err := cronJobs.List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to list cron jobs: %v", err)
+	}
+	for _, cj := range jobs.Items {
+		if cj.Spec.Suspend != nil && *cj.Spec.Suspend {
+			continue // already suspended by someone else
+		}
+		setAnnotation(&cj.ObjectMeta, suspendedAnnotation, "true")
+		suspend := true
+		cj.Spec.Suspend = &suspend
+		if _, err := cronJobs.Update(ctx, &cj, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("unable to suspend cron job %v: %v", cj.Name, err)
+		}
+	}
+	return nil
+}
+
+// Undo the changes made by scaleDownWorkloads
+func (o *k8s) restoreWorkloads(ctx context.Context, namespace string) error {
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
+	apps := o.clientset.AppsV1()
+	deployments, err := apps.Deployments(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to list deployments: %v", err)
+	}
+	for _, d := range deployments.Items {
+		if replicas, ok := savedReplicas(&d.ObjectMeta); ok {
+			d.Spec.Replicas = &replicas
+			if _, err := apps.Deployments(namespace).Update(ctx, &d, metav1.UpdateOptions{}); err != nil {
+				return fmt.Errorf("unable to scale up deployment %v: %v", d.Name, err)
+			}
+		}
+	}
+	sets, err := apps.StatefulSets(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to list stateful sets: %v", err)
+	}
+	for _, ss := range sets.Items {
+		if replicas, ok := savedReplicas(&ss.ObjectMeta); ok {
+			ss.Spec.Replicas = &replicas
+			if _, err := apps.StatefulSets(namespace).Update(ctx, &ss, metav1.UpdateOptions{}); err != nil {
+				return fmt.Errorf("unable to scale up stateful set %v: %v", ss.Name, err)
+			}
+		}
+	}
+	cronJobs := o.clientset.BatchV1().CronJobs(namespace)
+	jobs, err := cronJobs.List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to list cron jobs: %v", err)
+	}
+	for _, cj := range jobs.Items {
+		if _, ok := cj.Annotations[suspendedAnnotation]; !ok {
+			continue
+		}
+		delete(cj.Annotations, suspendedAnnotation)
+		suspend := false
+		cj.Spec.Suspend = &suspend
+		if _, err := cronJobs.Update(ctx, &cj, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("unable to resume cron job %v: %v", cj.Name, err)
+		}
+	}
+	return nil
+}
+
+// Record the replica count before scaling down, returns false if there's
+// nothing to scale down
+func scaledDown(meta *metav1.ObjectMeta, replicas *int32) bool {
+	if replicas != nil && *replicas == 0 {
+		return false
+	}
+	count := int32(1) // default when not specified
+	if replicas != nil {
+		count = *replicas
+	}
+	setAnnotation(meta, replicasAnnotation, strconv.Itoa(int(count)))
+	return true
+}
+
+// Remove the recorded replica count and return it
+func savedReplicas(meta *metav1.ObjectMeta) (int32, bool) {
+	value, ok := meta.Annotations[replicasAnnotation]
+	if !ok {
+		return 0, false
+	}
+	delete(meta.Annotations, replicasAnnotation)
+	replicas, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Ignoring invalid replicas annotation %v on %v", value, meta.Name)
+		return 0, false
+	}
+	return int32(replicas), true
+}
+
+func setAnnotation(meta *metav1.ObjectMeta, key string, value string) {
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
+	}
+	meta.Annotations[key] = value
+}
+
+func (o *k8s) getNamespaces(ctx context.Context) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
+	var items []*v1.Namespace
+	if o.listers != nil {
+		var err error
+		if items, err = o.listers.namespaces.List(labels.Everything()); err != nil {
+			return nil, fmt.Errorf("unable to list namespaces: %v", err)
+		}
+	} else {
+		nsList, err := o.clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("unable to list namepsaces: %v", err)
+		}
+		items = pointers(nsList.Items)
 	}
-	items := nsList.Items
 	result := make([]string, len(items))
 	for i, next := range items {
 		result[i] = next.ObjectMeta.Name
@@ -94,38 +476,146 @@ func (o *k8s) getNamespaces() ([]string, error) {
 	return result, nil
 }
 
-func (o *k8s) getResourceQuota(ns string, rqName string) (*v1.ResourceQuota, error) {
-	return o.clientset.CoreV1().ResourceQuotas(ns).Get(context.Background(), rqName, metav1.GetOptions{})
+// Total allocatable memory of all nodes in bytes
+func (o *k8s) getAllocatableMemory(ctx context.Context) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
+	nodes, err := o.clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("unable to list nodes: %v", err)
+	}
+	total := int64(0)
+	for _, node := range nodes.Items {
+		total += node.Status.Allocatable.Memory().Value()
+	}
+	return total, nil
 }
 
-func (o *k8s) hasResourceQuota(ns string, rqName string) bool {
-	_, err := o.getResourceQuota(ns, rqName)
+// Storage requested by persistent volume claims, including those that are
+// still pending
+func (o *k8s) getStorageUsage(ctx context.Context, ns string) (storageUsage, error) {
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
+	usage := storageUsage{Classes: map[string]int64{}}
+	var claims []*v1.PersistentVolumeClaim
+	if o.listers != nil {
+		var err error
+		if claims, err = o.listers.claims.PersistentVolumeClaims(ns).List(labels.Everything()); err != nil {
+			return usage, fmt.Errorf("unable to list persistent volume claims: %v", err)
+		}
+	} else {
+		list, err := o.clientset.CoreV1().PersistentVolumeClaims(ns).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return usage, fmt.Errorf("unable to list persistent volume claims: %v", err)
+		}
+		claims = pointers(list.Items)
+	}
+	for _, pvc := range claims {
+		requested := pvc.Spec.Resources.Requests.Storage().Value()
+		usage.Requests += requested
+		usage.Claims++
+		if class := pvc.Spec.StorageClassName; class != nil && *class != "" {
+			usage.Classes[*class] += requested
+		}
+	}
+	return usage, nil
+}
+
+func (o *k8s) getResourceQuota(ctx context.Context, ns string, rqName string) (*v1.ResourceQuota, error) {
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
+	if o.listers != nil {
+		return o.listers.quotas.ResourceQuotas(ns).Get(rqName)
+	}
+	return o.clientset.CoreV1().ResourceQuotas(ns).Get(ctx, rqName, metav1.GetOptions{})
+}
+
+func (o *k8s) hasResourceQuota(ctx context.Context, ns string, rqName string) bool {
+	_, err := o.getResourceQuota(ctx, ns, rqName)
 	return err == nil
 }
 
-func (o *k8s) setResourceQuota(ns string, rqName string, limit resource.Quantity) (*v1.ResourceQuota, error) {
+func (o *k8s) setResourceQuota(ctx context.Context, ns string, rqName string, limit resource.Quantity) (*v1.ResourceQuota, error) {
+	return o.setResourceQuotaHard(ctx, ns, rqName, v1.ResourceList{v1.ResourceMemory: limit})
+}
+
+func (o *k8s) setResourceQuotaHard(ctx context.Context, ns string, rqName string, hard v1.ResourceList) (*v1.ResourceQuota, error) {
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
 	rq := &v1.ResourceQuota{
 		ObjectMeta: metav1.ObjectMeta{Name: rqName},
-		Spec: v1.ResourceQuotaSpec{
-			Hard: v1.ResourceList{
-				v1.ResourceMemory: limit,
-			},
-		},
+		Spec:       v1.ResourceQuotaSpec{Hard: hard},
 	}
 	rqs := o.clientset.CoreV1().ResourceQuotas(ns)
-	if o.hasResourceQuota(ns, rqName) {
-		return rqs.Update(context.Background(), rq, metav1.UpdateOptions{})
+	updated, err := rqs.Update(ctx, rq, metav1.UpdateOptions{})
+	if errors.IsNotFound(err) {
+		return rqs.Create(ctx, rq, metav1.CreateOptions{})
 	}
-	return rqs.Create(context.Background(), rq, metav1.CreateOptions{})
+	return updated, err
 }
 
-func (o *k8s) removeResourceQuota(ns string, rqName string) error {
-	return o.clientset.CoreV1().ResourceQuotas(ns).Delete(context.Background(), rqName, metav1.DeleteOptions{})
+func (o *k8s) getResourceQuotas(ctx context.Context, ns string) ([]v1.ResourceQuota, error) {
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
+	if o.listers != nil {
+		quotas, err := o.listers.quotas.ResourceQuotas(ns).List(labels.Everything())
+		return values(quotas), err
+	}
+	list, err := o.clientset.CoreV1().ResourceQuotas(ns).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// Server-side apply only the given limits, so any other limits set on the
+// quota by other tools are left alone
+func (o *k8s) applyResourceQuota(ctx context.Context, ns string, rqName string, hard v1.ResourceList) (*v1.ResourceQuota, error) {
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
+	rq := corev1apply.ResourceQuota(rqName, ns).
+		WithSpec(corev1apply.ResourceQuotaSpec().WithHard(hard))
+	return o.clientset.CoreV1().ResourceQuotas(ns).Apply(ctx, rq,
+		metav1.ApplyOptions{FieldManager: fieldManager, Force: true})
 }
 
-// Create default limit range for namespace if it doesn't exist
-func (o *k8s) checkLimitRange(ns string) {
-	status, err := o.getStatusOf(ns)
+// Limits of a quota that were applied by the reaper
+func appliedLimits(rq *v1.ResourceQuota) v1.ResourceList {
+	applied := v1.ResourceList{}
+	for _, entry := range rq.ManagedFields {
+		if entry.Manager != fieldManager || entry.FieldsV1 == nil {
+			continue
+		}
+		var fields struct {
+			Spec struct {
+				Hard map[string]interface{} `json:"f:hard"`
+			} `json:"f:spec"`
+		}
+		if err := json.Unmarshal(entry.FieldsV1.Raw, &fields); err != nil {
+			continue
+		}
+		for field := range fields.Spec.Hard {
+			name := v1.ResourceName(strings.TrimPrefix(field, "f:"))
+			if value, ok := rq.Spec.Hard[name]; ok {
+				applied[name] = value
+			}
+		}
+	}
+	return applied
+}
+
+func (o *k8s) removeResourceQuota(ctx context.Context, ns string, rqName string) error {
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
+	return o.clientset.CoreV1().ResourceQuotas(ns).Delete(ctx, rqName, metav1.DeleteOptions{})
+}
+
+// Create limit range for namespace if it doesn't exist, or update it
+// if it's different from the one required
+func (o *k8s) checkLimitRange(ctx context.Context, ns string, item v1.LimitRangeItem) {
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
+	status, err := o.getStatusOf(ctx, ns)
 	if err != nil {
 		log.Printf("Ignoring limit range for %v because it has no status", ns)
 		return
@@ -137,18 +627,99 @@ func (o *k8s) checkLimitRange(ns string) {
 
 	lr := &v1.LimitRange{
 		ObjectMeta: metav1.ObjectMeta{Name: limitRangeName},
-		Spec: v1.LimitRangeSpec{
-			Limits: []v1.LimitRangeItem{{
-				Type:           v1.LimitTypeContainer,
-				DefaultRequest: v1.ResourceList{v1.ResourceMemory: resource.MustParse(podRequest)},
-				Default:        v1.ResourceList{v1.ResourceMemory: resource.MustParse(podLimit)},
-			}},
-		},
+		Spec:       v1.LimitRangeSpec{Limits: []v1.LimitRangeItem{item}},
 	}
 	lrs := o.clientset.CoreV1().LimitRanges(ns)
-	_, err = lrs.Get(context.Background(), limitRangeName, metav1.GetOptions{})
+	existing, err := o.getLimitRange(ctx, ns)
 	if err != nil {
 		log.Printf("Creating default limit range for %v", ns)
-		lrs.Create(context.Background(), lr, metav1.CreateOptions{})
+		lrs.Create(ctx, lr, metav1.CreateOptions{})
+		return
+	}
+	if !sameLimitRange(existing.Spec, lr.Spec) {
+		log.Printf("Updating limit range for %v", ns)
+		_, err = lrs.Update(ctx, lr, metav1.UpdateOptions{})
+		if err != nil {
+			log.Printf("Unable to update limit range for %v: %v", ns, err)
+		}
+	}
+}
+
+func (o *k8s) getLimitRange(ctx context.Context, ns string) (*v1.LimitRange, error) {
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
+	if o.listers != nil {
+		return o.listers.limitRanges.LimitRanges(ns).Get(limitRangeName)
+	}
+	return o.clientset.CoreV1().LimitRanges(ns).Get(ctx, limitRangeName, metav1.GetOptions{})
+}
+
+func (o *k8s) getLimitRanges(ctx context.Context, ns string) ([]v1.LimitRange, error) {
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
+	if o.listers != nil {
+		ranges, err := o.listers.limitRanges.LimitRanges(ns).List(labels.Everything())
+		return values(ranges), err
+	}
+	list, err := o.clientset.CoreV1().LimitRanges(ns).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// Server-side apply the limit range for a namespace, unless another limit
+// range already provides container defaults
+func (o *k8s) applyLimitRange(ctx context.Context, ns string, item v1.LimitRangeItem) {
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
+	status, err := o.getStatusOf(ctx, ns)
+	if err != nil || status != "Active" {
+		return
+	}
+	existing, err := o.getLimitRanges(ctx, ns)
+	if err != nil {
+		log.Printf("Unable to get limit ranges for %v: %v", ns, err)
+		return
+	}
+	spec := v1.LimitRangeSpec{Limits: []v1.LimitRangeItem{item}}
+	for _, lr := range existing {
+		if lr.Name == limitRangeName && sameLimitRange(lr.Spec, spec) {
+			return
+		}
+		if lr.Name != limitRangeName && setsContainerDefaults(lr) {
+			return
+		}
+	}
+
+	log.Printf("Applying limit range for %v", ns)
+	lr := corev1apply.LimitRange(limitRangeName, ns).
+		WithSpec(corev1apply.LimitRangeSpec().WithLimits(corev1apply.LimitRangeItem().
+			WithType(item.Type).
+			WithDefaultRequest(item.DefaultRequest).
+			WithDefault(item.Default).
+			WithMin(item.Min).
+			WithMax(item.Max)))
+	_, err = o.clientset.CoreV1().LimitRanges(ns).Apply(ctx, lr,
+		metav1.ApplyOptions{FieldManager: fieldManager, Force: true})
+	if err != nil {
+		log.Printf("Unable to apply limit range for %v: %v", ns, err)
+	}
+}
+
+func sameLimitRange(a v1.LimitRangeSpec, b v1.LimitRangeSpec) bool {
+	if len(a.Limits) != len(b.Limits) {
+		return false
+	}
+	for i, item := range a.Limits {
+		other := b.Limits[i]
+		if item.Type != other.Type ||
+			!sameResources(item.DefaultRequest, other.DefaultRequest) ||
+			!sameResources(item.Default, other.Default) ||
+			!sameResources(item.Min, other.Min) ||
+			!sameResources(item.Max, other.Max) {
+			return false
+		}
 	}
+	return true
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// header set on requests forwarded to the leader, so they aren't forwarded again
+const forwardedHeader = "X-Reaper-Forwarded"
+
+// Which replica is the leader. Only the leader reaps, reconciles quotas
+// and limit ranges, and saves configs.
+type leadership struct {
+	leading atomic.Bool
+	leader  atomic.Value // identity of the current leader, its address
+}
+
+// Without leader election there's only one replica, which always leads
+func newLeadership(electing bool) *leadership {
+	l := &leadership{}
+	l.leading.Store(!electing)
+	l.leader.Store("")
+	return l
+}
+
+func (l *leadership) isLeader() bool {
+	return l.leading.Load()
+}
+
+func (l *leadership) current() string {
+	return l.leader.Load().(string)
+}
+
+// Identity used in the lease, the address other replicas forward writes to
+func identity(spec Specification) string {
+	host := spec.PodIP
+	if host == "" {
+		host, _ = os.Hostname()
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// Take part in leader elections until the context is done
+func elect(ctx context.Context, s state) {
+	l := s.leader
+	id := identity(s.Spec)
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Name: s.Spec.LeaseName, Namespace: s.Spec.LeaseNamespace},
+		Client:     s.cluster.clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: id},
+	}
+	for ctx.Err() == nil {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			ReleaseOnCancel: true,
+			LeaseDuration:   15 * time.Second,
+			RenewDeadline:   10 * time.Second,
+			RetryPeriod:     2 * time.Second,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(context.Context) {
+					log.Printf("Leading as %v", id)
+					l.leading.Store(true)
+				},
+				OnStoppedLeading: func() {
+					if l.leading.Swap(false) {
+						log.Printf("No longer leading")
+					}
+				},
+				OnNewLeader: func(leader string) {
+					log.Printf("Leader is %v", leader)
+					l.leader.Store(leader)
+				},
+			},
+		})
+	}
+}
+
+// Forward requests to the leader, unless this replica is the leader
+func forward(l *leadership, wrapped http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if l.isLeader() {
+			wrapped(w, r)
+			return
+		}
+		leader := l.current()
+		if leader == "" || r.Header.Get(forwardedHeader) != "" {
+			writeError(w, newError(http.StatusServiceUnavailable, "no leader available, try again later"))
+			return
+		}
+		proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: leader})
+		r.Header.Set(forwardedHeader, "true")
+		proxy.ServeHTTP(w, r)
+	}
+}
@@ -5,28 +5,65 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/sethvargo/go-envconfig"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
 const timeFormat = "15:04 MST"
+const apiTimeout = 10 * time.Second
 const quotaName = "reaper-quota"
 const downQuotaName = "reaper-down-quota"
 const bytesInGi = 1024 * 1024 * 1024
+const bytesInMi = 1024 * 1024
 const defaultLimit = 10
 const limitRangeName = "reaper-limit"
 const podRequest = "512Mi"
 const podLimit = "512Mi"
+const podCPURequest = "100m"
+const podCPULimit = "1"
 const window = 8 // hours in uptime window
-const configMapName = "podreaper-goconfig"
+const port = "8080"
+const defaultNamespace = "podreaper"
+const namespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+const migratedAnnotation = "podreaper/migrated"
+const podsConfigMapName = "reaper-pods"
+const recreateAnnotation = "podreaper/recreate"
+const tokenVolumePrefix = "kube-api-access-"
+const managedByLabel = "app.kubernetes.io/managed-by"
+const ownerLabel = "podreaper.io/owner"
+const managedBy = "podreaper"
+const replicasAnnotation = "podreaper/replicas"
+const suspendedAnnotation = "podreaper/suspended"
+const warningAnnotation = "podreaper/stopping-at"
+const adoptAnnotation = "podreaper/adopt"
+const startHourAnnotation = "podreaper/start-hour"
+const memoryLimitAnnotation = "podreaper/memory-limit"
+const windowAnnotation = "podreaper/window"
+const fieldManager = "pod-reaper"
+
+// how the reaper writes quotas and limit ranges
+const quotaModeReplace = "replace" // own the whole object
+const quotaModeApply = "apply"     // server-side apply only the reaper's limits
+
+// shutdown phases of a namespace
+const phaseRunning = "running"
+const phaseScaledDown = "scaledDown" // soft stop, workloads scaled to zero
+const phaseStopped = "stopped"       // hard stop, down quota and pods deleted
 
 func main() {
 	// load the configuration
@@ -35,27 +72,92 @@ func main() {
 	if err := envconfig.Process(ctx, &spec); err != nil {
 		log.Fatalf("Can't load environment vars: %v", err)
 	}
+	spec = withHomeNamespace(spec, namespaceFile)
+	log.Printf("Namespace: %v", spec.Namespace)
+	log.Printf("Config Map: %v", configMapLocation(spec))
 	log.Printf("Zone ID: %v", spec.ZoneID)
 	log.Printf("Ignored Namespaces: %v", spec.IgnoredNamespaces)
+	log.Printf("Recreate Pods: %v", spec.RecreatePods)
+	log.Printf("Soft Stop: %v, Hard Stop Delay: %v", spec.SoftStop, spec.HardStopDelay)
+	log.Printf("Quota Mode: %v", spec.QuotaMode)
+	log.Printf("Leader Election: %v", spec.LeaderElection)
+	log.Printf("Config Store: %v", spec.ConfigStore)
+	if spec.ConfigStore != storeConfigMap && spec.ConfigStore != storeSchedules {
+		log.Fatalf("Invalid Config Store: %v", spec.ConfigStore)
+	}
+	if spec.QuotaMode != quotaModeReplace && spec.QuotaMode != quotaModeApply {
+		log.Fatalf("Invalid Quota Mode: %v", spec.QuotaMode)
+	}
+	log.Printf("Annotation Precedence: %v", spec.AnnotationPrecedence)
+	if spec.AnnotationPrecedence != precedenceAnnotations && spec.AnnotationPrecedence != precedenceUI {
+		log.Fatalf("Invalid Annotation Precedence: %v", spec.AnnotationPrecedence)
+	}
+	log.Printf("Shutdown Timeout: %v", spec.ShutdownTimeout)
 	location, err := time.LoadLocation(spec.ZoneID)
 	if err != nil {
 		log.Fatalf("Invalid Zone ID: %v", err)
 	}
 
-	var clientset *kubernetes.Clientset
+	var config *rest.Config
 	if spec.InCluster {
 		log.Printf("Using in-cluster configuration")
-		clientset = initInCluster()
+		config = initInCluster()
 	} else {
 		log.Printf("Using out-of-cluster configuration")
-		clientset = initOutOfCluster()
+		config = initOutOfCluster()
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		log.Fatalf("Unable to create client: %v", err)
+	}
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		log.Fatalf("Unable to create dynamic client: %v", err)
+	}
+
+	// stop on SIGTERM or when a restart is requested
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	ctx, shutdown := context.WithCancel(ctx)
+	defer shutdown()
+
+	cluster := k8s{clientset: clientset, dynamic: dynamicClient}
+	if spec.ConfigStore == storeSchedules {
+		err := migrateConfigs(ctx, newConfigMapStore(cluster, configMapLocation(spec)), newScheduleStore(cluster, spec.Namespace))
+		if err != nil {
+			log.Printf("Unable to migrate configs to schedules: %v", err)
+		}
+	}
+	s := newState(spec, *location, cluster)
+	if err := s.cluster.watch(ctx, spec.ResyncPeriod, s.changed); err != nil {
+		log.Fatalf("Unable to watch namespaces: %v", err)
+	}
+	if store, ok := s.store.(watchedStore); ok {
+		if err := store.watch(ctx, spec.ResyncPeriod, s.storeChanged); err != nil {
+			log.Fatalf("Unable to watch config store: %v", err)
+		}
 	}
 
-	s := newState(spec, *location, k8s{clientset: clientset})
-	go maintainStatus(s)
-	go maintainNamespaces(s)
-	go maintainLimitRanges(s)
-	go reap(s)
+	// the status stops last, so pending configs can still be saved once
+	// everything else has stopped, and leadership is only given up after
+	// that so the final save is still made by the leader
+	final, finish := context.WithCancel(context.Background())
+	electing, resign := context.WithCancel(context.Background())
+	var stopped, finished, resigned sync.WaitGroup
+	run := func(ctx context.Context, wg *sync.WaitGroup, loop func(context.Context, state)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			loop(ctx, s)
+		}()
+	}
+	if spec.LeaderElection {
+		run(electing, &resigned, elect)
+	}
+	run(final, &finished, maintainStatus)
+	run(ctx, &stopped, maintainNamespaces)
+	run(ctx, &stopped, reap)
+	run(ctx, &stopped, maintainBudget)
 
 	// Allow CORS for dev only
 	cors := func(wrapped http.HandlerFunc) http.HandlerFunc {
@@ -66,7 +168,7 @@ func main() {
 					h.Set("Access-Control-Allow-Origin", origin)
 				}
 				if r.Method == "OPTIONS" {
-					h.Set("Access-Control-Allow-Methods", "POST")
+					h.Set("Access-Control-Allow-Methods", "POST, PUT")
 					h.Set("Access-Control-Allow-Headers", "content-type")
 					return // no content for OPTIONS requests
 				}
@@ -75,66 +177,351 @@ func main() {
 		}
 	}
 
-	// always return the status
-	status := func(wrapped http.HandlerFunc) http.HandlerFunc {
+	// always return the status, unless the request was rejected
+	status := func(process processor) http.HandlerFunc {
 		return func(w http.ResponseWriter, r *http.Request) {
-			wrapped(w, r)
+			err := process(r)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
 			w.Header().Set("Content-Type", "application/json")
 			fmt.Fprint(w, <-s.getStatus)
 		}
 	}
 
 	// request processors, nothing required for a simple status request
-	doNothing := func(w http.ResponseWriter, r *http.Request) {}
+	doNothing := func(r *http.Request) error { return nil }
 
-	restart := func(w http.ResponseWriter, r *http.Request) {
+	restart := func(r *http.Request) error {
 		log.Printf("Restarting")
-		os.Exit(0)
+		shutdown()
+		return nil
 	}
 
-	memLimitProcessor := func(w http.ResponseWriter, r *http.Request) {
-		decoder := json.NewDecoder(r.Body)
+	memLimitProcessor := func(r *http.Request) error {
 		var lr limitRequest
-		err := decoder.Decode(&lr)
-		if err != nil {
-			log.Printf("Unable to set mem limit: %v", err)
-			return
+		if err := decode(r, &lr); err != nil {
+			return err
+		}
+		if err := knownNamespace(lr.Namespace, s); err != nil {
+			return err
+		}
+		if lr.Limit == nil && lr.Memory == nil && lr.Limits == nil && lr.LimitRatio == nil {
+			return badRequest("one of limit, memory, limits or limitRatio is required")
+		}
+		cfg := s.getConfigFor(lr.Namespace)
+		if lr.Limit != nil || lr.Memory != nil {
+			if err := checkDeclared(cfg, "memoryLimit"); err != nil {
+				return err
+			}
+			limit := lr.Memory
+			if limit == nil {
+				gi := gibibytes(*lr.Limit)
+				limit = &gi
+			}
+			if err := validateLimit(*limit, spec); err != nil {
+				return err
+			}
+			cfg = withMemLimit(cfg, *limit)
+		}
+		if lr.Limits != nil || lr.LimitRatio != nil {
+			cfg = withMemLimits(cfg, lr.Limits, lr.LimitRatio)
+		}
+		if err := validateMemLimits(cfg, spec); err != nil {
+			return err
+		}
+		return s.updateWithinBudget(cfg)
+	}
+	cpuLimitProcessor := func(r *http.Request) error {
+		var cr cpuLimitRequest
+		if err := decode(r, &cr); err != nil {
+			return err
+		}
+		if err := knownNamespace(cr.Namespace, s); err != nil {
+			return err
+		}
+		if err := validateCPU(cr.CPURequest, cr.CPULimit); err != nil {
+			return err
+		}
+		cfg := s.getConfigFor(cr.Namespace)
+		cfg.CPURequest = cr.CPURequest
+		cfg.CPULimit = cr.CPULimit
+		s.updateNsConfig <- cfg
+		return nil
+	}
+	limitRangeProcessor := func(r *http.Request) error {
+		var lr limitRangeRequest
+		if err := decode(r, &lr); err != nil {
+			return err
+		}
+		if err := knownNamespace(lr.Namespace, s); err != nil {
+			return err
 		}
 		cfg := s.getConfigFor(lr.Namespace)
-		cfg.Limit = lr.Limit
+		if err := validateLimitRange(lr.LimitRange, cfg); err != nil {
+			return err
+		}
+		cfg.LimitRange = lr.LimitRange
 		s.updateNsConfig <- cfg
+		return nil
 	}
-	startHourProcessor := func(w http.ResponseWriter, r *http.Request) {
-		decoder := json.NewDecoder(r.Body)
+	startHourProcessor := func(r *http.Request) error {
 		var sr startRequest
-		err := decoder.Decode(&sr)
-		if err != nil {
-			log.Printf("Unable to set start hour: %v", err)
-			return
+		if err := decode(r, &sr); err != nil {
+			return err
+		}
+		if err := knownNamespace(sr.Namespace, s); err != nil {
+			return err
+		}
+		if err := validateStartHour(sr.StartHour); err != nil {
+			return err
 		}
 		cfg := s.getConfigFor(sr.Namespace)
+		if err := checkDeclared(cfg, "startHour"); err != nil {
+			return err
+		}
 		cfg.AutoStartHour = sr.StartHour
 		s.updateNsConfig <- cfg
+		return nil
 	}
-	extendProcessor := func(w http.ResponseWriter, r *http.Request) {
-		decoder := json.NewDecoder(r.Body)
+	extendProcessor := func(r *http.Request) error {
 		var sr startRequest
-		err := decoder.Decode(&sr)
+		if err := decode(r, &sr); err != nil {
+			return err
+		}
+		state, ok := s.getStateFor(sr.Namespace)
+		if !ok {
+			return knownNamespace(sr.Namespace, s)
+		}
+		cfg := s.getConfigFor(sr.Namespace)
+		now := time.Now().In(location)
+		err := checkExtend(policyFor(cfg, spec), cfg, state, now)
 		if err != nil {
-			log.Printf("Unable to extend namespace: %v", err)
-			return
+			return newError(http.StatusConflict, "unable to extend %v: %v", sr.Namespace, err)
+		}
+		cfg = recordExtend(cfg, now)
+		cfg.LastStarted = now.Unix() - 1
+		s.updateNsConfig <- cfg
+		return nil
+	}
+	extendPolicyProcessor := func(r *http.Request) error {
+		var pr policyRequest
+		if err := decode(r, &pr); err != nil {
+			return err
+		}
+		if err := knownNamespace(pr.Namespace, s); err != nil {
+			return err
+		}
+		if err := validatePolicy(pr.Policy); err != nil {
+			return err
+		}
+		cfg := s.getConfigFor(pr.Namespace)
+		cfg.ExtendPolicy = pr.Policy
+		s.updateNsConfig <- cfg
+		return nil
+	}
+
+	storageProcessor := func(r *http.Request) error {
+		var sr storageRequest
+		if err := decode(r, &sr); err != nil {
+			return err
+		}
+		if err := knownNamespace(sr.Namespace, s); err != nil {
+			return err
+		}
+		if err := validateStorage(sr.Storage); err != nil {
+			return err
 		}
 		cfg := s.getConfigFor(sr.Namespace)
-		cfg.LastStarted = time.Now().Unix() - 1
+		cfg.Storage = sr.Storage
+		s.updateNsConfig <- cfg
+		return nil
+	}
+	priorityProcessor := func(r *http.Request) error {
+		var pr priorityRequest
+		if err := decode(r, &pr); err != nil {
+			return err
+		}
+		if err := knownNamespace(pr.Namespace, s); err != nil {
+			return err
+		}
+		cfg := s.getConfigFor(pr.Namespace)
+		cfg.Priority = pr.Priority
 		s.updateNsConfig <- cfg
+		return nil
+	}
+
+	// return the limit range used for a namespace
+	limitRange := func(w http.ResponseWriter, r *http.Request) {
+		ns := r.URL.Query().Get("namespace")
+		if err := knownNamespace(ns, s); err != nil {
+			writeError(w, err)
+			return
+		}
+		cfg := s.getConfigFor(ns)
+		item := limitRangeFor(cfg)
+		response, _ := json.Marshal(limitRangeResponse{
+			Namespace: ns,
+			LimitRange: limitRangeConfig{
+				DefaultRequest: item.DefaultRequest,
+				Default:        item.Default,
+				Min:            item.Min,
+				Max:            item.Max,
+			},
+			Overrides: cfg.LimitRange,
+		})
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, string(response))
+	}
+
+	// roll back a namespace, or every namespace, to the settings of a revision
+	rollbackProcessor := func(r *http.Request) error {
+		var rr rollbackRequest
+		if err := decode(r, &rr); err != nil {
+			return err
+		}
+		namespaces := []string{rr.Namespace}
+		if rr.Namespace == "" {
+			namespaces = []string{}
+			for _, state := range <-s.getStates {
+				namespaces = append(namespaces, state.Name)
+			}
+		} else if err := knownNamespace(rr.Namespace, s); err != nil {
+			return err
+		}
+		history, err := s.history.load(r.Context())
+		if err != nil {
+			return err
+		}
+		rev, ok := findRevision(history, rr.Revision)
+		if !ok {
+			return newError(http.StatusNotFound, "unknown revision %v", rr.Revision)
+		}
+		if err := rollback(namespaces, rev, s); err != nil {
+			return err
+		}
+		log.Printf("Rolled back %v to revision %v", namespaces, rr.Revision)
+		return nil
+	}
+
+	// return the recorded revisions of the config, oldest first
+	revisions := func(w http.ResponseWriter, r *http.Request) {
+		history, err := s.history.load(r.Context())
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		response, _ := json.Marshal(history)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, string(response))
+	}
+
+	// export the settings of every namespace as JSON, or YAML if asked for
+	exportConfig := func(w http.ResponseWriter, r *http.Request) {
+		asYAML := r.URL.Query().Get("format") == "yaml" || strings.Contains(r.Header.Get("Accept"), "yaml")
+		response, err := exportConfigs(<-s.getConfigs, asYAML)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if asYAML {
+			w.Header().Set("Content-Type", "application/yaml")
+		}
+		w.Write(response)
+	}
+
+	// import settings, merged with or replacing the current ones, returning
+	// the changes made or that would be made for a dry run
+	importConfig := func(w http.ResponseWriter, r *http.Request) {
+		mode := r.URL.Query().Get("mode")
+		if mode == "" {
+			mode = importMerge
+		}
+		if mode != importMerge && mode != importReplace {
+			writeError(w, badRequest("mode must be %v or %v", importMerge, importReplace))
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, badRequest("invalid request: %v", err))
+			return
+		}
+		imported, err := parseConfigs(body)
+		if err == nil {
+			err = validateConfigs(imported, spec)
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		result := importResponse{
+			DryRun:  r.URL.Query().Get("dryRun") == "true",
+			Changes: planImport(s.configMap(), imported, mode),
+		}
+		if err := importChanges(result.Changes, result.DryRun, s); err != nil {
+			writeError(w, err)
+			return
+		}
+		if !result.DryRun {
+			log.Printf("Imported config, %v namespaces changed", len(result.Changes))
+		}
+		response, _ := json.Marshal(result)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, string(response))
+	}
+	configs := func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			exportConfig(w, r)
+		case http.MethodPut:
+			forward(s.leader, importConfig)(w, r)
+		default:
+			writeError(w, newError(http.StatusMethodNotAllowed, "%v not allowed, use GET or PUT", r.Method))
+		}
+	}
+
+	// list the configs kept for deleted namespaces
+	listTombstones := func(w http.ResponseWriter, r *http.Request) {
+		response, _ := json.Marshal(tombstones(<-s.getConfigs, spec.TombstoneRetention, &s.timeZone))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, string(response))
+	}
+	purgeProcessor := func(r *http.Request) error {
+		var pr purgeRequest
+		if err := decode(r, &pr); err != nil {
+			return err
+		}
+		if cfg, ok := s.configMap()[pr.Namespace]; pr.Namespace != "" && (!ok || cfg.Deleted == 0) {
+			return newError(http.StatusNotFound, "no config kept for deleted namespace '%v'", pr.Namespace)
+		}
+		s.rmTombstones <- pr.Namespace
+		return nil
 	}
 
 	// process requests and serve latest cached JSON status
 	http.HandleFunc("/reaper/status", cors(status(doNothing)))
-	http.HandleFunc("/reaper/setMemLimit", cors(status(memLimitProcessor)))
-	http.HandleFunc("/reaper/setStartHour", cors(status(startHourProcessor)))
-	http.HandleFunc("/reaper/extend", cors(status(extendProcessor)))
-	http.HandleFunc("/reaper/restart", cors(status(restart)))
+	http.HandleFunc("/reaper/limitRange", cors(limitRange))
+	http.HandleFunc("/reaper/revisions", cors(revisions))
+	http.HandleFunc("/reaper/config", cors(configs))
+	http.HandleFunc("/reaper/tombstones", cors(listTombstones))
+
+	// changes are made by the leader, other replicas forward them
+	write := func(process processor) http.HandlerFunc {
+		return forward(s.leader, cors(status(post(process))))
+	}
+	http.HandleFunc("/reaper/setMemLimit", write(memLimitProcessor))
+	http.HandleFunc("/reaper/setCpuLimit", write(cpuLimitProcessor))
+	http.HandleFunc("/reaper/setStorage", write(storageProcessor))
+	http.HandleFunc("/reaper/setLimitRange", write(limitRangeProcessor))
+	http.HandleFunc("/reaper/setStartHour", write(startHourProcessor))
+	http.HandleFunc("/reaper/extend", write(extendProcessor))
+	http.HandleFunc("/reaper/setExtendPolicy", write(extendPolicyProcessor))
+	http.HandleFunc("/reaper/setPriority", write(priorityProcessor))
+	http.HandleFunc("/reaper/rollback", write(rollbackProcessor))
+	http.HandleFunc("/reaper/purgeTombstones", write(purgeProcessor))
+	http.HandleFunc("/reaper/restart", cors(status(post(restart))))
 
 	// serve the front end static files
 	if spec.StaticFiles != "" {
@@ -142,30 +529,67 @@ func main() {
 		http.Handle("/", fs)
 	}
 
-	err = http.ListenAndServe(":8080", nil)
-	if err != nil {
-		log.Fatalf("Exit: %v", err)
+	server := &http.Server{Addr: ":" + port}
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Exit: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Printf("Shutting down")
+	drain, cancel := context.WithTimeout(context.Background(), spec.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(drain); err != nil {
+		log.Printf("Unable to finish requests: %v", err)
+	}
+	stopped.Wait()
+	finish()
+	finished.Wait()
+	resign()
+	resigned.Wait()
+	log.Printf("Stopped")
+}
+
+// Default the namespaces for the reaper's own objects to the one it runs in,
+// from the service account if not set, and make sure it isn't reaped
+func withHomeNamespace(spec Specification, namespaceFile string) Specification {
+	if spec.Namespace == "" {
+		spec.Namespace = defaultNamespace
+		if data, err := os.ReadFile(namespaceFile); err == nil && strings.TrimSpace(string(data)) != "" {
+			spec.Namespace = strings.TrimSpace(string(data))
+		}
+	}
+	if spec.ConfigMapNamespace == "" {
+		spec.ConfigMapNamespace = spec.Namespace
+	}
+	if spec.LeaseNamespace == "" {
+		spec.LeaseNamespace = spec.Namespace
 	}
+	if !contains(spec.IgnoredNamespaces, spec.Namespace) {
+		spec.IgnoredNamespaces = append(spec.IgnoredNamespaces, spec.Namespace)
+	}
+	return spec
+}
+
+func configMapLocation(spec Specification) types.NamespacedName {
+	return types.NamespacedName{Namespace: spec.ConfigMapNamespace, Name: spec.ConfigMapName}
 }
 
 // Use in-cluster config to connect to k8s api
 // see https://github.com/kubernetes/client-go/blob/master/examples/in-cluster-client-configuration/main.go
-func initInCluster() *kubernetes.Clientset {
+func initInCluster() *rest.Config {
 	config, err := rest.InClusterConfig()
 	if err != nil {
 		panic(err.Error())
 	}
-	// creates the clientset
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		panic(err.Error())
-	}
-	return clientset
+	return config
 }
 
 // Use local kubeconfig to connect to k8s api
 // see https://github.com/kubernetes/client-go/tree/master/examples/out-of-cluster-client-configuration
-func initOutOfCluster() *kubernetes.Clientset {
+func initOutOfCluster() *rest.Config {
 	var kubeconfig *string
 	if home := homeDir(); home != "" {
 		kubeconfig = flag.String("kubeconfig", filepath.Join(home, ".kube", "config"), "(optional) absolute path to the kubeconfig file")
@@ -179,13 +603,7 @@ func initOutOfCluster() *kubernetes.Clientset {
 	if err != nil {
 		panic(err.Error())
 	}
-
-	// create the clientset
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		panic(err.Error())
-	}
-	return clientset
+	return config
 }
 
 func homeDir() string {
@@ -1,147 +1,322 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"sort"
+	"strings"
 	"time"
 
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 )
 
-// Update namespaces in the background
-func maintainNamespaces(s state) {
-	// Each running namespace has an update ticker
-	// This map holds close channels for stopping the tickers
-	tickers := map[string](chan bool){}
-
-	checkNamespaces(tickers, s) // don't wait for first tick
-	tick := time.Tick(s.Spec.NamespacesTick)
-	for {
-		select {
-		case <-tick:
-			checkNamespaces(tickers, s)
-
-		case ns := <-s.triggerNs:
-			err := updateNamespace(ns, s)
-			if err != nil {
-				log.Printf("Unable to update namespace %v: %v", ns, err)
-				if !s.cluster.getExists(ns) {
-					log.Printf("Removing namespace: %v", ns)
-					tickers[ns] <- true
-					delete(tickers, ns)
-					s.rmNamespace <- ns
-				}
-			}
+func updateNamespace(ctx context.Context, name string, s state) error {
+	ns, err := s.cluster.getNamespace(ctx, name)
+	if err != nil {
+		return err
+	}
+	if ns.Status.Phase != v1.NamespaceActive {
+		return fmt.Errorf("namespace %v is %v", name, ns.Status.Phase)
+	}
+	declared, errs := declared(ns, s.Spec)
+	if err := checkDeclaredBudget(name, &declared, s); err != nil {
+		errs = append(errs, err)
+	}
+	var annotationErrors []string
+	for _, err := range errs {
+		log.Printf("Ignoring invalid annotation on %v: %v", name, err)
+		annotationErrors = append(annotationErrors, err.Error())
+	}
+	var rq *v1.ResourceQuota
+	if s.leader.isLeader() {
+		rq, _ = checkQuota(ctx, name, declared, s)
+		reconcileLimitRange(ctx, name, s)
+	} else {
+		rq = currentQuota(ctx, name, s)
+	}
+	updated, err := loadNamespace(ctx, name, rq, declared, s)
+	if err == nil {
+		updated.Conflicts = findConflicts(ctx, name, declared, s)
+		updated.AnnotationErrors = annotationErrors
+		if s.leader.isLeader() {
+			warn(ctx, updated, s)
 		}
+		s.updateNsState <- updated
 	}
+	return err
 }
 
-// Periodically check for new namespaces
-func checkNamespaces(tickers map[string](chan bool), s state) {
-	namespaces, err := s.cluster.getNamespaces()
+// Annotate namespaces that are about to be stopped with the stop time
+func warn(ctx context.Context, state nsState, s state) {
+	stopsAt := ""
+	if state.StoppingSoon {
+		stopsAt = state.StopsAt
+	}
+	err := s.cluster.annotateNamespace(ctx, state.Name, warningAnnotation, stopsAt)
 	if err != nil {
-		log.Printf("Unable to retrieve namespaces: %v", err)
-		return
+		log.Printf("Unable to set warning annotation on %v: %v", state.Name, err)
 	}
+}
 
-	// get the names of valid namespaces by removing the ignored ones
-	valid := []string{}
-	for _, next := range namespaces {
-		if !contains(s.Spec.IgnoredNamespaces, next) {
-			valid = append(valid, next)
+func loadNamespace(ctx context.Context, name string, rq *v1.ResourceQuota, declared declaredConfig, s state) (nsState, error) {
+	memUsed, memLimitsUsed := resource.Quantity{}, resource.Quantity{}
+	cpuRequests, cpuLimits := int64(0), int64(0)
+	if rq != nil {
+		memUsed = *quantity(rq.Status.Used, v1.ResourceRequestsMemory)
+		if _, ok := rq.Status.Used[v1.ResourceRequestsMemory]; !ok {
+			memUsed = *rq.Status.Used.Memory() // quota from older versions
 		}
+		memLimitsUsed = *quantity(rq.Status.Used, v1.ResourceLimitsMemory)
+		cpuRequests = quantity(rq.Status.Used, v1.ResourceRequestsCPU).MilliValue()
+		cpuLimits = quantity(rq.Status.Used, v1.ResourceLimitsCPU).MilliValue()
+	}
+	storage, err := s.cluster.getStorageUsage(ctx, name)
+	if err != nil {
+		log.Printf("Unable to get storage used by %v: %v", name, err)
 	}
+	cfg := s.getConfigFor(name)
+	cfg.Declared = &declared
+	return withTimings(nsState{
+		Name:          name,
+		HasDownQuota:  s.cluster.hasResourceQuota(ctx, name, downQuotaName),
+		MemUsed:       memUsed,
+		MemLimitsUsed: memLimitsUsed,
+		CPURequests:   int(cpuRequests),
+		CPULimits:     int(cpuLimits),
+		Storage:       storage,
+		Declared:      declared,
+	}, cfg, time.Now(), s), nil
+}
 
-	// Start tickers for any new namespaces
-	for _, ns := range valid {
-		if _, ok := tickers[ns]; !ok {
-			tickers[ns] = createTickerFor(ns, s)
-		}
+// Update the fields of a namespace state that change as time passes,
+// without anything in the cluster changing
+func withTimings(state nsState, cfg nsConfig, now time.Time, s state) nsState {
+	now = now.In(&s.timeZone)
+	hour, _ := startHour(cfg)
+	state.LastScheduled = lastScheduled(hour, now)
+	lastStarted := max(cfg.LastStarted, state.LastScheduled)
+	seconds := remainingSeconds(lastStarted, now.Unix(), windowOf(cfg))
+	state.Remaining = remaining(seconds, windowOf(cfg))
+	state.StoppingSoon = seconds > 0 && seconds <= int64(s.Spec.WarningPeriod.Seconds())
+	state.StopsAt = ""
+	if seconds > 0 {
+		state.StopsAt = formatTime(now.Unix()+seconds, &s.timeZone)
 	}
+	return state
+}
 
-	// remove namespaces that have been deleted
-	// this will make sure it gets removed if the namespace ticker fails
-	for _, state := range <-s.getStates {
-		if !contains(valid, state.Name) {
-			s.rmNamespace <- state.Name
+// Check if there's a quota for the namespace, create one if not
+func checkQuota(ctx context.Context, ns string, declared declaredConfig, s state) (*v1.ResourceQuota, error) {
+	cfg := s.getConfigFor(ns)
+	cfg.Declared = &declared
+	hard := quotaFor(cfg, s.Spec)
+	if s.Spec.QuotaMode == quotaModeApply {
+		return applyQuota(ctx, ns, hard, s)
+	}
+	quota, err := s.cluster.getResourceQuota(ctx, ns, quotaName)
+	if err != nil {
+		log.Printf("Creating default quota for %v", ns)
+		quota, err = s.cluster.setResourceQuotaHard(ctx, ns, quotaName, hard)
+		if err != nil {
+			log.Printf("Unable to create quota for %v: %v", ns, err)
 		}
+		return quota, err
+	}
+	if !sameResources(quota.Spec.Hard, hard) {
+		quota, err = s.cluster.setResourceQuotaHard(ctx, ns, quotaName, hard)
+		log.Printf("Updated %v quota to %v", ns, describe(hard))
 	}
+	return quota, err
+}
+
+// The quota the reaper manages for a namespace, without changing it
+func currentQuota(ctx context.Context, ns string, s state) *v1.ResourceQuota {
+	if s.Spec.QuotaMode == quotaModeApply {
+		quotas, _ := s.cluster.getResourceQuotas(ctx, ns)
+		return adoptedQuota(quotas)
+	}
+	quota, _ := s.cluster.getResourceQuota(ctx, ns, quotaName)
+	return quota
 }
 
-// Create a ticker to trigger updates for a particular namespace
-func createTickerFor(name string, s state) chan bool {
-	ticker := time.NewTicker(s.Spec.NamespaceTick)
-	done := make(chan bool)
-	go func() {
-		for {
-			select {
-			case <-done:
-				ticker.Stop()
-				return
-			case <-ticker.C:
-				s.triggerNs <- name
+// Apply the reaper's limits to the adopted quota, or its own quota if none
+// has been adopted, without touching limits set by other tools
+func applyQuota(ctx context.Context, ns string, hard v1.ResourceList, s state) (*v1.ResourceQuota, error) {
+	quotas, err := s.cluster.getResourceQuotas(ctx, ns)
+	if err != nil {
+		return nil, err
+	}
+	name := quotaName
+	quota := adoptedQuota(quotas)
+	if quota != nil {
+		name = quota.Name
+		if name != quotaName && hasQuota(quotas, quotaName) {
+			log.Printf("Removing %v quota replaced by %v", ns, name)
+			if err := s.cluster.removeResourceQuota(ctx, ns, quotaName); err != nil {
+				log.Printf("Unable to remove %v quota: %v", ns, err)
 			}
 		}
-	}()
-	return done
+		if sameResources(appliedLimits(quota), hard) {
+			return quota, nil
+		}
+	}
+	quota, err = s.cluster.applyResourceQuota(ctx, ns, name, hard)
+	if err != nil {
+		log.Printf("Unable to apply quota %v for %v: %v", name, ns, err)
+		return nil, err
+	}
+	log.Printf("Applied %v quota %v to %v", ns, name, describe(hard))
+	return quota, nil
 }
 
-func updateNamespace(name string, s state) error {
-	status, err := s.cluster.getStatusOf(name)
+// The quota annotated for adoption, otherwise the reaper's own quota, or nil
+func adoptedQuota(quotas []v1.ResourceQuota) *v1.ResourceQuota {
+	var own *v1.ResourceQuota
+	for i, rq := range quotas {
+		if rq.Annotations[adoptAnnotation] == "true" {
+			return &quotas[i]
+		}
+		if rq.Name == quotaName {
+			own = &quotas[i]
+		}
+	}
+	return own
+}
+
+func hasQuota(quotas []v1.ResourceQuota, name string) bool {
+	for _, rq := range quotas {
+		if rq.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Describe other quotas and limit ranges in a namespace that set the same
+// limits as the reaper
+func findConflicts(ctx context.Context, ns string, declared declaredConfig, s state) []string {
+	quotas, err := s.cluster.getResourceQuotas(ctx, ns)
 	if err != nil {
-		return err
+		log.Printf("Unable to get quotas for %v: %v", ns, err)
 	}
-	if status != "Active" {
-		return fmt.Errorf("namespace %v is %v", name, status)
+	ranges, err := s.cluster.getLimitRanges(ctx, ns)
+	if err != nil {
+		log.Printf("Unable to get limit ranges for %v: %v", ns, err)
 	}
-	rq, _ := checkQuota(name, s)
-	updated, err := loadNamespace(name, rq, s)
-	if err == nil {
-		s.updateNsState <- updated
+	cfg := s.getConfigFor(ns)
+	cfg.Declared = &declared
+	hard := quotaFor(cfg, s.Spec)
+	return conflicts(quotas, ranges, hard, s.Spec.QuotaMode == quotaModeApply)
+}
+
+func conflicts(quotas []v1.ResourceQuota, ranges []v1.LimitRange, hard v1.ResourceList, apply bool) []string {
+	managed := ""
+	if apply {
+		if quota := adoptedQuota(quotas); quota != nil {
+			managed = quota.Name
+		}
 	}
-	return err
+	found := []string{}
+	for _, rq := range quotas {
+		if rq.Name == quotaName || rq.Name == downQuotaName || rq.Name == managed {
+			continue
+		}
+		names := []string{}
+		for name := range rq.Spec.Hard {
+			if _, ok := hard[requestsName(name)]; ok {
+				names = append(names, string(name))
+			}
+		}
+		if len(names) > 0 {
+			sort.Strings(names)
+			found = append(found, fmt.Sprintf("ResourceQuota %v sets %v", rq.Name, strings.Join(names, ", ")))
+		}
+	}
+	for _, lr := range ranges {
+		if lr.Name != limitRangeName && setsContainerDefaults(lr) {
+			found = append(found, fmt.Sprintf("LimitRange %v sets container defaults", lr.Name))
+		}
+	}
+	return found
 }
 
-func loadNamespace(name string, rq *v1.ResourceQuota, s state) (nsState, error) {
-	memUsed := int64(0)
-	if rq != nil {
-		memUsed = rq.Status.Used.Memory().Value() / bytesInGi
+// Quota limits for a namespace config, anything but memory requests is only included if set
+func quotaFor(cfg nsConfig, spec Specification) v1.ResourceList {
+	hard := v1.ResourceList{
+		v1.ResourceRequestsMemory: *memLimit(cfg),
 	}
-	cfg := s.getConfigFor(name)
-	now := time.Now().In(&s.timeZone)
-	lastScheduled := lastScheduled(cfg.AutoStartHour, now)
-	lastStarted := max(cfg.LastStarted, lastScheduled)
-	seconds := remainingSeconds(lastStarted, now.Unix())
-	return nsState{
-		Name:          name,
-		HasDownQuota:  s.cluster.hasResourceQuota(name, downQuotaName),
-		MemUsed:       int(memUsed),
-		Remaining:     remaining(seconds),
-		LastScheduled: lastScheduled,
-	}, nil
+	if limits := memLimitsQuota(cfg, spec); limits != nil {
+		hard[v1.ResourceLimitsMemory] = *limits
+	}
+	if cfg.CPURequest > 0 {
+		hard[v1.ResourceRequestsCPU] = *resource.NewMilliQuantity(int64(cfg.CPURequest), resource.DecimalSI)
+	}
+	if cfg.CPULimit > 0 {
+		hard[v1.ResourceLimitsCPU] = *resource.NewMilliQuantity(int64(cfg.CPULimit), resource.DecimalSI)
+	}
+	if storage := cfg.Storage; storage != nil {
+		if storage.Requests != nil {
+			hard[v1.ResourceRequestsStorage] = *storage.Requests
+		}
+		if storage.Claims > 0 {
+			hard[v1.ResourcePersistentVolumeClaims] = *resource.NewQuantity(int64(storage.Claims), resource.DecimalSI)
+		}
+		for class, value := range storage.Classes {
+			hard[storageClassResource(class)] = value
+		}
+	}
+	return hard
 }
 
-// Check if there's a quota for the namespace, create one if not
-func checkQuota(ns string, s state) (*v1.ResourceQuota, error) {
-	quota, err := s.cluster.getResourceQuota(ns, quotaName)
-	if err != nil {
-		log.Printf("Creating default quota for %v", ns)
-		quota, err = setQuota(ns, defaultLimit, s)
-		if err != nil {
-			log.Printf("Unable to create quota for %v: %v", ns, err)
+// quotas treat memory and cpu as the requests
+func requestsName(name v1.ResourceName) v1.ResourceName {
+	switch name {
+	case v1.ResourceMemory:
+		return v1.ResourceRequestsMemory
+	case v1.ResourceCPU:
+		return v1.ResourceRequestsCPU
+	}
+	return name
+}
+
+// quota resource for storage requested from a storage class
+func storageClassResource(class string) v1.ResourceName {
+	return v1.ResourceName(class + ".storageclass.storage.k8s.io/" + string(v1.ResourceRequestsStorage))
+}
+
+func sameResources(a v1.ResourceList, b v1.ResourceList) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, value := range a {
+		other, ok := b[name]
+		if !ok || value.Cmp(other) != 0 {
+			return false
 		}
 	}
-	limit := quota.Spec.Hard.Memory().Value()
-	cfg := s.getConfigFor(ns)
-	if cfg.Limit != int(limit/bytesInGi) {
-		quota, err = setQuota(ns, int64(cfg.Limit), s)
-		log.Printf("Updated %v limit to %v", ns, cfg.Limit)
+	return true
+}
+
+// value from resource list, zero if not present
+func quantity(list v1.ResourceList, name v1.ResourceName) *resource.Quantity {
+	if value, ok := list[name]; ok {
+		return &value
 	}
-	return quota, err
+	return resource.NewQuantity(0, resource.DecimalSI)
 }
 
-func setQuota(ns string, limit int64, s state) (*v1.ResourceQuota, error) {
-	value := resource.NewQuantity(limit*bytesInGi, resource.Format("BinarySI"))
-	return s.cluster.setResourceQuota(ns, quotaName, *value)
+func describe(list v1.ResourceList) string {
+	names := []string{}
+	for name := range list {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	parts := []string{}
+	for _, name := range names {
+		value := list[v1.ResourceName(name)]
+		parts = append(parts, fmt.Sprintf("%v=%v", name, value.String()))
+	}
+	return strings.Join(parts, ", ")
 }
@@ -0,0 +1,65 @@
+package main
+
+import "sort"
+
+// Namespaces waiting to start because the cluster is out of capacity,
+// with the time each one was queued
+type startQueue map[string]int64
+
+// Update the queue with the namespaces that want to start, then admit
+// them in order while there's enough capacity. Returns the admitted
+// namespaces with the time they were queued.
+func (q startQueue) admit(wanting map[string]nsConfig, budget memBudget, now int64) map[string]int64 {
+	for name := range wanting {
+		if _, ok := q[name]; !ok {
+			q[name] = now
+		}
+	}
+	for name := range q {
+		if _, ok := wanting[name]; !ok {
+			delete(q, name) // no longer wants to start
+		}
+	}
+
+	admitted := map[string]int64{}
+	available := budget.Available.Bytes
+	for _, name := range q.order(wanting) {
+		limit := memLimit(wanting[name]).Value()
+		if budget.Total.Bytes > 0 && limit > available {
+			break // first in line has to start before anyone else
+		}
+		available -= limit
+		admitted[name] = q[name]
+		delete(q, name)
+	}
+	return admitted
+}
+
+// Highest priority first, then in the order they were queued
+func (q startQueue) order(cfgs map[string]nsConfig) []string {
+	names := []string{}
+	for name := range q {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := names[i], names[j]
+		if cfgs[a].Priority != cfgs[b].Priority {
+			return cfgs[a].Priority > cfgs[b].Priority
+		}
+		if q[a] != q[b] {
+			return q[a] < q[b]
+		}
+		return a < b
+	})
+	return names
+}
+
+// Position in the queue starting from 1, zero if not queued
+func queuePosition(queue []string, ns string) int {
+	for i, name := range queue {
+		if name == ns {
+			return i + 1
+		}
+	}
+	return 0
+}
@@ -1,12 +1,63 @@
 package main
 
-import "time"
+import (
+	"context"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
 
-func maintainLimitRanges(s state) {
-	tick := time.Tick(s.Spec.RangerTick)
-	for range tick {
-		for _, state := range <-s.getStates {
-			s.cluster.checkLimitRange(state.Name)
+// Make sure a namespace has the limit range from its config
+func reconcileLimitRange(ctx context.Context, ns string, s state) {
+	item := limitRangeFor(s.getConfigFor(ns))
+	if s.Spec.QuotaMode == quotaModeApply {
+		s.cluster.applyLimitRange(ctx, ns, item)
+	} else {
+		s.cluster.checkLimitRange(ctx, ns, item)
+	}
+}
+
+// Default container limits, overridden by any values in the namespace config
+func limitRangeFor(cfg nsConfig) v1.LimitRangeItem {
+	item := v1.LimitRangeItem{
+		Type: v1.LimitTypeContainer,
+		DefaultRequest: v1.ResourceList{
+			v1.ResourceMemory: resource.MustParse(podRequest),
+			v1.ResourceCPU:    resource.MustParse(podCPURequest),
+		},
+		Default: v1.ResourceList{
+			v1.ResourceMemory: resource.MustParse(podLimit),
+			v1.ResourceCPU:    resource.MustParse(podCPULimit),
+		},
+	}
+	if lr := cfg.LimitRange; lr != nil {
+		item.DefaultRequest = merged(item.DefaultRequest, lr.DefaultRequest)
+		item.Default = merged(item.Default, lr.Default)
+		item.Min = merged(nil, lr.Min)
+		item.Max = merged(nil, lr.Max)
+	}
+	return item
+}
+
+// Whether a limit range sets default container requests or limits
+func setsContainerDefaults(lr v1.LimitRange) bool {
+	for _, item := range lr.Spec.Limits {
+		if item.Type == v1.LimitTypeContainer && (len(item.Default) > 0 || len(item.DefaultRequest) > 0) {
+			return true
 		}
 	}
+	return false
+}
+
+func merged(defaults v1.ResourceList, overrides v1.ResourceList) v1.ResourceList {
+	if len(defaults) == 0 && len(overrides) == 0 {
+		return nil
+	}
+	result := v1.ResourceList{}
+	for name, value := range defaults {
+		result[name] = value
+	}
+	for name, value := range overrides {
+		result[name] = value
+	}
+	return result
 }
@@ -1,62 +1,181 @@
 package main
 
 import (
+	"context"
 	"log"
 	"time"
 
 	"k8s.io/apimachinery/pkg/api/resource"
 )
 
-func reap(s state) {
-	tick := time.Tick(s.Spec.ReaperTick)
-	for range tick {
+func reap(ctx context.Context, s state) {
+	queue := startQueue{}
+	tick := time.NewTicker(s.Spec.ReaperTick)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		if !s.leader.isLeader() {
+			continue
+		}
+		now := time.Now().Unix()
 		cfgs := s.configMap()
+		states := map[string]nsState{}
 		for _, state := range <-s.getStates {
-			ns := state.Name
+			if _, ok := cfgs[state.Name]; !ok {
+				cfgs[state.Name] = nsConfig{Name: state.Name, Limit: defaultLimit}
+			}
+			states[state.Name] = state
+		}
+
+		// stopped namespaces that should start have to wait for capacity
+		wanting := map[string]nsConfig{}
+		for ns, state := range states {
+			cfg := cfgs[ns]
+			started := max(state.LastScheduled, cfg.LastStarted)
+			if now-started < windowOf(cfg) && currentPhase(cfg, state) != phaseRunning {
+				wanting[ns] = cfg
+			}
+		}
+		budget := newBudget(<-s.getBudget, usedBudget(cfgs, states, ""))
+		admitted := queue.admit(wanting, budget, now)
+		s.updateQueue <- queue.order(cfgs)
+
+		for ns, state := range states {
 			cfg := cfgs[ns]
+			changed := false
 			started := max(state.LastScheduled, cfg.LastStarted)
 
-			// update lastStarted for scheduled starts
+			// update lastStarted for scheduled starts, or when the
+			// namespace had to wait in the queue
+			if queued, ok := admitted[ns]; ok && queued < now {
+				log.Printf("Starting %v after waiting in queue", ns)
+				started = now
+			}
 			if started > cfg.LastStarted {
 				cfg.LastStarted = started
-				s.updateNsConfig <- cfg
+				changed = true
 			}
 
-			// change up/down state
-			shouldRun := hoursFrom(started, time.Now().Unix()) < window
-			if !state.HasDownQuota && !shouldRun {
-				bringDown(ns, s)
+			// move through the shutdown phases
+			_, waiting := queue[ns]
+			shouldRun := now-started < windowOf(cfg) && !waiting
+			phase := currentPhase(cfg, state)
+			next := nextPhase(ctx, phase, shouldRun, ns, cfg, s)
+			if next != phase || cfg.Phase == "" {
+				log.Printf("Namespace %v is %v", ns, next)
+				if phase == phaseRunning && next != phaseRunning {
+					cfg.LastStopped = now
+				}
+				cfg.Phase = next
+				cfg.PhaseChanged = now
+				changed = true
 			}
-			if state.HasDownQuota && shouldRun {
-				bringUp(ns, s)
+			if next == phaseRunning && state.HasDownQuota {
+				bringUp(ctx, ns, s)
+			}
+			if next == phaseStopped && !state.HasDownQuota {
+				bringDown(ctx, ns, s)
 			}
 
 			// kill any pods that are running
-			if !shouldRun {
-				err := s.cluster.deletePods(ns)
+			if next == phaseStopped {
+				err := s.cluster.deletePods(ctx, ns)
 				if err != nil {
 					log.Printf("Unable to delete pods in %v: %v", ns, err)
 				}
 			}
+
+			if changed {
+				s.updateNsConfig <- cfg
+			}
 		}
 	}
 }
 
-func bringUp(ns string, s state) {
-	if s.cluster.hasResourceQuota(ns, downQuotaName) {
-		err := s.cluster.removeResourceQuota(ns, downQuotaName)
+// Phase of a namespace, configs saved before phases were introduced are
+// derived from the down quota
+func currentPhase(cfg nsConfig, state nsState) string {
+	if cfg.Phase != "" {
+		return cfg.Phase
+	}
+	if state.HasDownQuota {
+		return phaseStopped
+	}
+	return phaseRunning
+}
+
+// Work out the next phase, scaling workloads down or back up as required.
+// A soft stop becomes a hard stop once the delay has passed if anything is
+// still running.
+func nextPhase(ctx context.Context, phase string, shouldRun bool, ns string, cfg nsConfig, s state) string {
+	if shouldRun {
+		if phase != phaseRunning {
+			err := s.cluster.restoreWorkloads(ctx, ns)
+			if err != nil {
+				log.Printf("Unable to restore workloads in %v: %v", ns, err)
+			}
+		}
+		return phaseRunning
+	}
+	switch phase {
+	case phaseRunning:
+		if !s.Spec.SoftStop {
+			return phaseStopped
+		}
+		err := s.cluster.scaleDownWorkloads(ctx, ns)
+		if err != nil {
+			log.Printf("Unable to scale down %v: %v", ns, err)
+		}
+		return phaseScaledDown
+	case phaseScaledDown:
+		since := time.Duration(time.Now().Unix()-cfg.PhaseChanged) * time.Second
+		if since < s.Spec.HardStopDelay {
+			return phaseScaledDown
+		}
+		running, err := s.cluster.countRunningPods(ctx, ns)
+		if err != nil {
+			log.Printf("Unable to check running pods in %v: %v", ns, err)
+			return phaseScaledDown
+		}
+		if running > 0 {
+			return phaseStopped
+		}
+		return phaseScaledDown
+	}
+	return phaseStopped
+}
+
+func bringUp(ctx context.Context, ns string, s state) {
+	if s.cluster.hasResourceQuota(ctx, ns, downQuotaName) {
+		err := s.cluster.removeResourceQuota(ctx, ns, downQuotaName)
 		if err != nil {
 			log.Printf("Unable to bring up %v: %v", ns, err)
 		} else {
 			log.Printf("Bringing up %v", ns)
+			if s.Spec.RecreatePods {
+				err = s.cluster.restoreBarePods(ctx, ns)
+				if err != nil {
+					log.Printf("Unable to recreate bare pods in %v: %v", ns, err)
+				}
+			}
 		}
 	}
 }
 
-func bringDown(ns string, s state) {
-	if !s.cluster.hasResourceQuota(ns, downQuotaName) {
+func bringDown(ctx context.Context, ns string, s state) {
+	if !s.cluster.hasResourceQuota(ctx, ns, downQuotaName) {
+		if s.Spec.RecreatePods {
+			err := s.cluster.snapshotBarePods(ctx, ns)
+			if err != nil {
+				log.Printf("Unable to save bare pods in %v: %v", ns, err)
+			}
+		}
 		value := resource.NewQuantity(0, resource.Format("BinarySI"))
-		_, err := s.cluster.setResourceQuota(ns, downQuotaName, *value)
+		_, err := s.cluster.setResourceQuota(ctx, ns, downQuotaName, *value)
 		if err != nil {
 			log.Printf("Unable to bring down %v: %v", ns, err)
 		} else {
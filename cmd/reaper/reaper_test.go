@@ -1,13 +1,34 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
 	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/util/workqueue"
 )
 
 // Note: Can't test deletePods because fake client doesn't support DeleteCollection
@@ -19,26 +40,88 @@ func newTestSimpleK8s() *k8s {
 }
 
 func TestNamespaceExists(t *testing.T) {
+	ctx := context.Background()
 	k8s := newTestSimpleK8s()
-	if k8s.getExists("default") {
+	if k8s.getExists(ctx, "default") {
 		t.Fatal("default namespace should not exist")
 	}
-	k8s.createNamespace("default")
-	k8s.getExists("default")
-	if !k8s.getExists("default") {
+	k8s.createNamespace(ctx, "default")
+	k8s.getExists(ctx, "default")
+	if !k8s.getExists(ctx, "default") {
 		t.Fatal("default namespace should exist")
 	}
 }
 
+func TestWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	k8s := newTestSimpleK8s()
+	changed := workqueue.New()
+	if err := k8s.watch(ctx, time.Hour, changed); err != nil {
+		t.Fatal(err)
+	}
+	nextChange := func() string {
+		item, _ := changed.Get()
+		changed.Done(item)
+		return item.(string)
+	}
+
+	k8s.createNamespace(ctx, "ns1")
+	check("ns1", nextChange(), t)
+	if !k8s.getExists(ctx, "ns1") {
+		t.Fatal("Namespace should be in the cache")
+	}
+
+	// changes to objects in a namespace queue the namespace
+	k8s.clientset.CoreV1().Pods("ns1").Create(ctx,
+		&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod1"}}, metav1.CreateOptions{})
+	check("ns1", nextChange(), t)
+	count, _ := k8s.countRunningPods(ctx, "ns1")
+	checkInt(1, int64(count), t)
+
+	k8s.setResourceQuota(ctx, "ns1", quotaName, resource.MustParse("10Gi"))
+	check("ns1", nextChange(), t)
+	if !k8s.hasResourceQuota(ctx, "ns1", quotaName) {
+		t.Fatal("Quota should be in the cache")
+	}
+}
+
+func TestAnnotateNamespace(t *testing.T) {
+	ctx := context.Background()
+	k8s := newTestSimpleK8s()
+	k8s.createNamespace(ctx, "default")
+	annotation := func() (string, bool) {
+		ns, _ := k8s.clientset.CoreV1().Namespaces().Get(ctx, "default", metav1.GetOptions{})
+		value, ok := ns.Annotations[warningAnnotation]
+		return value, ok
+	}
+
+	err := k8s.annotateNamespace(ctx, "default", warningAnnotation, "2019-11-13T20:00:00+08:00")
+	if err != nil {
+		t.Fatalf("Should be able to annotate namespace: %v", err)
+	}
+	value, _ := annotation()
+	check("2019-11-13T20:00:00+08:00", value, t)
+
+	err = k8s.annotateNamespace(ctx, "default", warningAnnotation, "")
+	if err != nil {
+		t.Fatalf("Should be able to remove annotation: %v", err)
+	}
+	if _, ok := annotation(); ok {
+		t.Fatal("Annotation should be removed")
+	}
+}
+
 func TestNamespaces(t *testing.T) {
+	ctx := context.Background()
 	k8s := newTestSimpleK8s()
-	namespaces, _ := k8s.getNamespaces()
+	namespaces, _ := k8s.getNamespaces(ctx)
 	if len(namespaces) != 0 {
 		t.Fatal("should not be any namespaces")
 	}
-	k8s.createNamespace("one")
-	k8s.createNamespace("two")
-	namespaces, _ = k8s.getNamespaces()
+	k8s.createNamespace(ctx, "one")
+	k8s.createNamespace(ctx, "two")
+	namespaces, _ = k8s.getNamespaces(ctx)
 	if len(namespaces) != 2 {
 		t.Fatalf("should be 2 namespaces not %v", len(namespaces))
 	}
@@ -47,11 +130,18 @@ func TestNamespaces(t *testing.T) {
 	}
 }
 
+// ConfigMap location of the default install
+var testConfigMap = types.NamespacedName{Namespace: defaultNamespace, Name: "podreaper-goconfig"}
+
 func TestSettings(t *testing.T) {
+	ctx := context.Background()
 	k8s := newTestSimpleK8s()
 
+	// a second reaper installed in another namespace
+	location := types.NamespacedName{Namespace: "staging-reaper", Name: "staging-config"}
+
 	// settings should not exist yet
-	_, err := k8s.getSettings()
+	_, _, err := k8s.getSettings(ctx, location)
 	if err == nil {
 		t.Fatal("settings should not exist")
 	}
@@ -72,16 +162,418 @@ func TestSettings(t *testing.T) {
 	}
 
 	// save settings, then retrieve and check
-	k8s.saveSettings(example)
-	settings, _ := k8s.getSettings()
+	k8s.saveSettings(ctx, location, example, "")
+	settings, _, _ := k8s.getSettings(ctx, location)
 	if !reflect.DeepEqual(settings, example) {
 		t.Fatalf("Save settings failed\nExpected: %v\nActual: %v", example, settings)
 	}
+	if _, _, err := k8s.getSettings(ctx, testConfigMap); err == nil {
+		t.Fatal("settings should only be saved in the given location")
+	}
+}
+
+func TestHomeNamespace(t *testing.T) {
+	spec := Specification{ConfigMapName: "podreaper-goconfig", IgnoredNamespaces: []string{"kube-system"}}
+	spec = withHomeNamespace(spec, filepath.Join(t.TempDir(), "missing"))
+	check("podreaper/podreaper-goconfig", configMapLocation(spec).String(), t)
+
+	// from the service account, unless set
+	file := filepath.Join(t.TempDir(), "namespace")
+	os.WriteFile(file, []byte("staging-reaper"), 0644)
+	spec = withHomeNamespace(Specification{ConfigMapName: "podreaper-goconfig", LeaseNamespace: "leases"}, file)
+	check("staging-reaper/podreaper-goconfig", configMapLocation(spec).String(), t)
+	check("leases", spec.LeaseNamespace, t)
+	if !contains(spec.IgnoredNamespaces, "staging-reaper") {
+		t.Fatal("The reaper's own namespace should be ignored")
+	}
+	spec = withHomeNamespace(Specification{Namespace: "reaper", ConfigMapNamespace: "configs"}, file)
+	check("reaper configs reaper", spec.Namespace+" "+spec.ConfigMapNamespace+" "+spec.LeaseNamespace, t)
+}
+
+// Make the fake clientset set ConfigMap resourceVersions and reject updates
+// of older versions, like the API server does
+func checkResourceVersions(clientset *fake.Clientset) {
+	version := 0
+	clientset.PrependReactor("*", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetVerb() != "create" && action.GetVerb() != "update" {
+			return false, nil, nil
+		}
+		cm := action.(k8stesting.CreateAction).GetObject().(*v1.ConfigMap)
+		if action.GetVerb() == "update" {
+			current, err := clientset.Tracker().Get(action.GetResource(), action.GetNamespace(), cm.Name)
+			if err == nil && current.(*v1.ConfigMap).ResourceVersion != cm.ResourceVersion {
+				return true, nil, errors.NewConflict(v1.Resource("configmaps"), cm.Name, fmt.Errorf("changed"))
+			}
+		}
+		version++
+		cm.ResourceVersion = fmt.Sprint(version)
+		return false, nil, nil
+	})
+}
+
+// Settings saved by every version of the reaper should still load
+func TestSettingsVersions(t *testing.T) {
+	saved := map[string]string{}
+	for _, version := range []string{"original", "cpu", "memory", "v1"} {
+		data, err := os.ReadFile(filepath.Join("testdata", "settings-"+version+".json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfgs, err := fromJSON(string(data))
+		if err != nil {
+			t.Fatalf("Unable to load %v settings: %v", version, err)
+		}
+		checkInt(2, int64(len(cfgs)), t)
+		check("default 10Gi 1589668156345", fmt.Sprint(cfgs[0].Name, " ", cfgs[0].Memory, " ", cfgs[0].LastStarted), t)
+		check("ns1 20Gi 9", fmt.Sprint(cfgs[1].Name, " ", cfgs[1].Memory, " ", *cfgs[1].AutoStartHour), t)
+		if version != "original" {
+			check("2000 50Gi 1", fmt.Sprint(cfgs[1].CPURequest, " ", cfgs[1].Storage.Requests, " ", cfgs[1].Extends), t)
+		}
+		saved[version], _ = toJSON(cfgs)
+	}
+
+	// the current version is saved unchanged, and is what the last
+	// unversioned settings are migrated to
+	data, _ := os.ReadFile(filepath.Join("testdata", "settings-v1.json"))
+	check(strings.TrimSpace(string(data)), saved["v1"], t)
+	check(saved["v1"], saved["memory"], t)
+
+	// settings saved by newer versions aren't loaded
+	if _, err := fromJSON(`{"apiVersion":"podreaper.io/v2","items":[]}`); err == nil {
+		t.Fatal("Newer settings versions should be rejected")
+	}
+}
+
+func TestSettingsConflict(t *testing.T) {
+	ctx := context.Background()
+	cluster := newTestSimpleK8s()
+	checkResourceVersions(cluster.clientset.(*fake.Clientset))
+	store := newConfigMapStore(*cluster, testConfigMap)
+	if _, err := store.save(ctx, []nsConfig{{Name: "ns1", Limit: 10}, {Name: "ns2", Limit: 10}}); err != nil {
+		t.Fatalf("Should be able to create settings: %v", err)
+	}
+
+	// changed by someone else, e.g. kubectl edit
+	other := newConfigMapStore(*cluster, testConfigMap)
+	other.load(ctx)
+	other.save(ctx, []nsConfig{{Name: "ns1", Limit: 10}, {Name: "ns2", Limit: 30}, {Name: "ns3", Limit: 10}})
+
+	// both changes are kept, and saving again doesn't need merging
+	saved, err := store.save(ctx, []nsConfig{{Name: "ns1", Limit: 15}, {Name: "ns2", Limit: 10}})
+	if err != nil {
+		t.Fatalf("Should merge conflicting changes: %v", err)
+	}
+	merged, _ := toJSON(saved)
+	loaded, _ := other.load(ctx)
+	current, _ := toJSON(loaded)
+	check(merged, current, t)
+	check(`{"apiVersion":"podreaper.io/v1","items":[`+
+		`{"name":"ns1","autoStartHour":null,"lastStarted":0,"limit":15},`+
+		`{"name":"ns2","autoStartHour":null,"lastStarted":0,"limit":30},`+
+		`{"name":"ns3","autoStartHour":null,"lastStarted":0,"limit":10}]}`, merged, t)
+	if _, err := store.save(ctx, saved[1:]); err != nil {
+		t.Fatalf("Should save over own changes: %v", err)
+	}
+	loaded, _ = other.load(ctx)
+	checkInt(2, int64(len(loaded)), t)
+}
+
+func TestConfigHistory(t *testing.T) {
+	ctx := context.Background()
+	spec := Specification{ConfigMapNamespace: "podreaper", ConfigMapName: "podreaper-goconfig", HistorySize: 2}
+	history := newConfigHistory(spec, *newTestSimpleK8s())
+	now := time.Date(2023, 6, 1, 9, 0, 0, 0, time.UTC)
+	history.record(ctx, []nsConfig{{Name: "ns1", Limit: 10}}, now)
+
+	// changes to the state kept by the reaper aren't new revisions
+	history.record(ctx, []nsConfig{{Name: "ns1", Limit: 10, LastStarted: now.Unix(), Phase: phaseRunning}}, now)
+	revisions, _ := history.load(ctx)
+	checkInt(1, int64(len(revisions)), t)
+
+	// only the latest revisions are kept
+	history.record(ctx, []nsConfig{{Name: "ns1", Limit: 20}}, now)
+	history.record(ctx, []nsConfig{{Name: "ns1", Limit: 30}, {Name: "ns2", Limit: 15}}, now)
+	revisions, _ = history.load(ctx)
+	checkInt(2, int64(len(revisions)), t)
+	checkInt(2, int64(revisions[0].Revision), t)
+	check("2023-06-01T09:00:00Z", revisions[1].Time, t)
+	if _, ok := findRevision(revisions, 1); ok {
+		t.Fatal("Revision 1 should have been dropped")
+	}
+
+	// roll back settings, keeping the state
+	rev, _ := findRevision(revisions, 2)
+	current := nsConfig{Name: "ns2", Limit: 15, LastStarted: now.Unix(), Phase: phaseRunning}
+	rolledBack := restored(current, rev.configFor("ns2"))
+	checkInt(defaultLimit, int64(rolledBack.Limit), t)
+	checkInt(now.Unix(), rolledBack.LastStarted, t)
+	check(phaseRunning, rolledBack.Phase, t)
+	checkInt(20, int64(restored(nsConfig{Name: "ns1"}, rev.configFor("ns1")).Limit), t)
+}
+
+func TestImportConfig(t *testing.T) {
+	spec := Specification{MinMemLimit: 1, MaxMemLimit: 100}
+	nine := 9
+	current := map[string]nsConfig{
+		"ns1": withMemLimit(nsConfig{Name: "ns1", AutoStartHour: &nine, LastStarted: 1000}, resource.MustParse("4Gi")),
+		"ns2": withMemLimit(nsConfig{Name: "ns2", Phase: phaseStopped}, resource.MustParse("8Gi")),
+	}
+
+	// exported YAML can be imported, without the state
+	exported, _ := exportConfigs(cfgArray(current), true)
+	imported, err := parseConfigs(exported)
+	if err != nil || validateConfigs(imported, spec) != nil {
+		t.Fatalf("Exported config should be valid: %v\n%s", err, exported)
+	}
+	checkInt(0, imported[0].LastStarted, t)
+	checkInt(0, int64(len(planImport(current, imported, importReplace))), t)
+
+	// configs kept for deleted namespaces aren't exported, or reset by
+	// importing the export
+	withTombstone := configsByName(append(cfgArray(current), nsConfig{Name: "ns3", Limit: 20, Deleted: 1000}))
+	exported, _ = exportConfigs(cfgArray(withTombstone), false)
+	imported, _ = parseConfigs(exported)
+	checkInt(2, int64(len(imported)), t)
+	checkInt(0, int64(len(planImport(withTombstone, imported, importReplace))), t)
+
+	// an imported entry for a deleted namespace is kept until it's created
+	checkInt(0, importedConfig(withTombstone["ns3"], nsConfig{Name: "ns3", Limit: 30}).Deleted, t)
+
+	// hand written entries get the default limit
+	imported, err = parseConfigs([]byte("- name: team-a\n  autoStartHour: 7\n"))
+	if err != nil || validateConfigs(imported, spec) != nil {
+		t.Fatalf("Entry without a limit should be valid: %v", err)
+	}
+	checkInt(defaultLimit, int64(imported[0].Limit), t)
+
+	// invalid documents are rejected
+	for _, doc := range []string{
+		`[{"name": "ns1", "limit": 10}, {"name": "ns1", "limit": 10}]`,
+		`[{"name": "ns1", "limit": 10, "autoStartHour": 24}]`,
+		`[{"name": "ns1", "limit": 200}]`,
+		`[{"name": "ns1", "limits": 10}]`,
+	} {
+		cfgs, err := parseConfigs([]byte(doc))
+		if err == nil && validateConfigs(cfgs, spec) == nil {
+			t.Fatalf("Should reject %v", doc)
+		}
+	}
+
+	// merge only changes namespaces in the document, including ones that
+	// don't exist yet, and replace resets the others
+	imported, _ = parseConfigs([]byte("- name: ns1\n  memory: 6Gi\n- name: ns3\n  memory: 2Gi\n"))
+	changes := planImport(current, imported, importMerge)
+	checkInt(2, int64(len(changes)), t)
+	check("ns1 update 6Gi", changes[0].Namespace+" "+changes[0].Action+" "+changes[0].After.Memory.String(), t)
+	check("ns3 add 2Gi", changes[1].Namespace+" "+changes[1].Action+" "+changes[1].After.Memory.String(), t)
+	if changes[0].After.AutoStartHour != nil || changes[0].Before.LastStarted != 0 {
+		t.Fatal("Imported settings should replace the namespace settings, without the state")
+	}
+	changes = planImport(current, imported, importReplace)
+	checkInt(3, int64(len(changes)), t)
+	check("ns2 reset 10", changes[1].Namespace+" "+changes[1].Action+" "+fmt.Sprint(changes[1].After.Limit), t)
+	checkInt(1000, restored(current["ns1"], changes[0].After).LastStarted, t)
+}
+
+func TestTombstones(t *testing.T) {
+	nine := 9
+	deleted := time.Date(2023, 6, 1, 9, 0, 0, 0, time.UTC).Unix()
+	configs := map[string]nsConfig{
+		"ns1": {Name: "ns1", Limit: 10},
+		"ns2": {Name: "ns2", Limit: 20, AutoStartHour: &nine, LastStarted: deleted - 60, Deleted: deleted},
+		"ns3": {Name: "ns3", Limit: 10, Deleted: deleted - 7*24*60*60},
+	}
+	kept := tombstones(cfgArray(configs), 7*24*time.Hour, time.UTC)
+	checkInt(2, int64(len(kept)), t)
+	check("ns2 2023-06-01T09:00:00Z 2023-06-08T09:00:00Z", kept[0].Namespace+" "+kept[0].Deleted+" "+kept[0].Expires, t)
+	checkInt(0, kept[0].Config.Deleted, t)
+
+	// expire after the retention period
+	check("[ns3]", fmt.Sprint(expiredTombstones(configs, deleted, 7*24*time.Hour)), t)
+	check("[ns2 ns3]", fmt.Sprint(expiredTombstones(configs, deleted+7*24*60*60, 7*24*time.Hour)), t)
+
+	// settings are restored when the namespace is created again
+	recreated := restored(nsConfig{Name: "ns2"}, configs["ns2"])
+	check("20 9 0 0", fmt.Sprint(recreated.Limit, " ", *recreated.AutoStartHour, " ", recreated.LastStarted, " ", recreated.Deleted), t)
+}
+
+func TestRecreatedNamespace(t *testing.T) {
+	s := newTestState()
+	s.Spec.TombstoneRetention = time.Hour
+	stop := runStatus(s)
+	defer stop()
+	s.updateNsConfig <- nsConfig{Name: "ns1", Limit: 20}
+	s.updateNsState <- nsState{Name: "ns1"}
+
+	// the config is kept when the namespace is deleted
+	s.rmNamespace <- "ns1"
+	if _, known := s.getStateFor("ns1"); known {
+		t.Fatal("Deleted namespace should be removed")
+	}
+	cfg := s.getConfigFor("ns1")
+	if cfg.Deleted == 0 || cfg.Limit != 20 {
+		t.Fatalf("Config of deleted namespace should be kept, but was %+v", cfg)
+	}
+
+	// and restored when it's created again
+	s.updateNsState <- nsState{Name: "ns1"}
+	cfg = s.getConfigFor("ns1")
+	if cfg.Deleted != 0 || cfg.Limit != 20 {
+		t.Fatalf("Config of recreated namespace should be restored, but was %+v", cfg)
+	}
+}
+
+func newTestScheduleStore() scheduleStore {
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{scheduleResource: "NamespaceScheduleList"})
+	return newScheduleStore(k8s{clientset: fake.NewSimpleClientset(), dynamic: client}, defaultNamespace)
+}
+
+func TestScheduleStore(t *testing.T) {
+	ctx := context.Background()
+	store := newTestScheduleStore()
+	nineAm := 9
+	memory := resource.MustParse("2560Mi")
+	example := []nsConfig{
+		{Name: "ns1", Limit: 10},
+		{Name: "ns2", AutoStartHour: &nineAm, LastStarted: 1589668156345, Limit: 2, Memory: &memory},
+	}
+	if _, err := store.save(ctx, example); err != nil {
+		t.Fatalf("Should be able to save schedules: %v", err)
+	}
+	loaded, _ := store.load(ctx)
+	if len(loaded) != 2 {
+		t.Fatalf("Expected 2 schedules but was %v", len(loaded))
+	}
+	byName := map[string]nsConfig{}
+	for _, cfg := range loaded {
+		byName[cfg.Name] = cfg
+	}
+	check("2560Mi", memLimit(byName["ns2"]).String(), t)
+	checkInt(9, int64(*byName["ns2"].AutoStartHour), t)
+	checkInt(1589668156345, byName["ns2"].LastStarted, t)
+
+	// only the settings are in the spec, the state is in the status
+	schedule, _ := store.schedules().Get(ctx, "ns2", metav1.GetOptions{})
+	if _, found, _ := unstructured.NestedFieldNoCopy(schedule.Object, "spec", "lastStarted"); found {
+		t.Fatal("State shouldn't be in the schedule spec")
+	}
+	if _, found, _ := unstructured.NestedFieldNoCopy(schedule.Object, "status", "state", "lastStarted"); !found {
+		t.Fatal("State should be in the schedule status")
+	}
+
+	// starting doesn't change the spec
+	example[1].LastStarted, example[1].Phase = 1589668156400, phaseRunning
+	store.save(ctx, example)
+	after, _ := store.schedules().Get(ctx, "ns2", metav1.GetOptions{})
+	if !reflect.DeepEqual(after.Object["spec"], schedule.Object["spec"]) {
+		t.Fatal("Schedule spec shouldn't change when the namespace starts")
+	}
+	loaded, _ = store.load(ctx)
+	check(phaseRunning, configsByName(loaded)["ns2"].Phase, t)
+
+	// schedules from older versions have the state in the spec
+	older := &unstructured.Unstructured{}
+	older.SetGroupVersionKind(scheduleResource.GroupVersion().WithKind("NamespaceSchedule"))
+	older.SetName("ns3")
+	older.Object["spec"] = map[string]interface{}{"limit": int64(15), "lastStarted": int64(1000)}
+	store.schedules().Create(ctx, older, metav1.CreateOptions{})
+	loaded, _ = store.load(ctx)
+	checkInt(1000, configsByName(loaded)["ns3"].LastStarted, t)
+	store.schedules().Delete(ctx, "ns3", metav1.DeleteOptions{})
+
+	// removed configs delete their schedule
+	store.save(ctx, example[1:])
+	loaded, _ = store.load(ctx)
+	if len(loaded) != 1 || loaded[0].Name != "ns2" {
+		t.Fatalf("Expected only ns2 but was %v", loaded)
+	}
+
+	// status from the namespace state
+	states := map[string]nsState{"ns2": {Name: "ns2", MemUsed: resource.MustParse("1Gi"), Remaining: "2h 5m"}}
+	err := store.saveStatus(ctx, scheduleStatuses(map[string]nsConfig{"ns2": example[1]}, states))
+	if err != nil {
+		t.Fatalf("Should be able to save status: %v", err)
+	}
+	schedule, _ = store.schedules().Get(ctx, "ns2", metav1.GetOptions{})
+	used, _, _ := unstructured.NestedString(schedule.Object, "status", "memUsed")
+	check("1Gi", used, t)
+	loaded, _ = store.load(ctx)
+	check(phaseRunning, configsByName(loaded)["ns2"].Phase, t)
+}
+
+func TestScheduleEdits(t *testing.T) {
+	ctx := context.Background()
+	store := newTestScheduleStore()
+	store.save(ctx, []nsConfig{{Name: "ns1", Limit: 10}, {Name: "ns2", Limit: 10}})
+
+	// edited with kubectl, and one created by another tool
+	schedule, _ := store.schedules().Get(ctx, "ns2", metav1.GetOptions{})
+	unstructured.SetNestedField(schedule.Object, int64(30), "spec", "limit")
+	store.schedules().Update(ctx, schedule, metav1.UpdateOptions{})
+	other := &unstructured.Unstructured{}
+	other.SetGroupVersionKind(scheduleResource.GroupVersion().WithKind("NamespaceSchedule"))
+	other.SetName("ns3")
+	other.Object["spec"] = map[string]interface{}{"limit": int64(15)}
+	store.schedules().Create(ctx, other, metav1.CreateOptions{})
+
+	// the next save only writes what changed here, and keeps the others
+	saved, err := store.save(ctx, []nsConfig{{Name: "ns1", Limit: 20}, {Name: "ns2", Limit: 10}})
+	if err != nil {
+		t.Fatalf("Should be able to save schedules: %v", err)
+	}
+	loaded, _ := store.load(ctx)
+	for _, cfgs := range [][]nsConfig{saved, loaded} {
+		byName := configsByName(cfgs)
+		check("20 30 15", fmt.Sprint(byName["ns1"].Limit, " ", byName["ns2"].Limit, " ", byName["ns3"].Limit), t)
+	}
+
+	// schedules this reaper didn't create aren't deleted, by another
+	// reaper either
+	store.save(ctx, []nsConfig{{Name: "ns2", Limit: 30}})
+	second := newScheduleStore(store.cluster, "staging-reaper")
+	second.load(ctx)
+	second.save(ctx, []nsConfig{})
+	loaded, _ = store.load(ctx)
+	check("[ns2 ns3]", fmt.Sprint(keys(configsByName(loaded))), t)
+}
+
+func keys(configs map[string]nsConfig) []string {
+	result := []string{}
+	for name := range configs {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func TestMigrateConfigs(t *testing.T) {
+	ctx := context.Background()
+	store := newTestScheduleStore()
+	from := newConfigMapStore(store.cluster, types.NamespacedName{Namespace: "staging-reaper", Name: "staging-config"})
+	from.save(ctx, []nsConfig{{Name: "ns1", Limit: 20}})
+
+	if err := migrateConfigs(ctx, from, store); err != nil {
+		t.Fatalf("Should be able to migrate: %v", err)
+	}
+	loaded, _ := store.load(ctx)
+	if len(loaded) != 1 || loaded[0].Limit != 20 {
+		t.Fatalf("Expected migrated ns1 config but was %v", loaded)
+	}
+
+	// only migrated once
+	store.save(ctx, []nsConfig{})
+	migrateConfigs(ctx, from, store)
+	loaded, _ = store.load(ctx)
+	if len(loaded) != 0 {
+		t.Fatalf("Configs shouldn't be migrated again but were %v", loaded)
+	}
 }
 
 func TestJSON(t *testing.T) {
-	example := "[{\"name\":\"default\",\"autoStartHour\":null,\"lastStarted\":1589668156345,\"limit\":10}," +
-		"{\"name\":\"ns1\",\"autoStartHour\":9,\"lastStarted\":0,\"limit\":20}]"
+	example := "{\"apiVersion\":\"podreaper.io/v1\",\"items\":[" +
+		"{\"name\":\"default\",\"autoStartHour\":null,\"lastStarted\":1589668156345,\"limit\":10}," +
+		"{\"name\":\"ns1\",\"autoStartHour\":9,\"lastStarted\":0,\"limit\":20}]}"
 	converted, _ := fromJSON(example)
 
 	restored, _ := toJSON(converted)
@@ -91,22 +583,23 @@ func TestJSON(t *testing.T) {
 }
 
 func TestResourceQuotas(t *testing.T) {
+	ctx := context.Background()
 	q2 := resource.Quantity{Format: "2Gi"}
 	q5 := resource.Quantity{Format: "5Gi"}
 
 	// should be no resource quota initially
 	k8s := newTestSimpleK8s()
-	rq, _ := k8s.getResourceQuota("default", "testrq")
+	rq, _ := k8s.getResourceQuota(ctx, "default", "testrq")
 	if rq != nil {
 		t.Fatalf("Not expecting to find resource quota: %v", rq)
 	}
 
 	// create
-	_, err := k8s.setResourceQuota("default", "testrq", q2)
+	_, err := k8s.setResourceQuota(ctx, "default", "testrq", q2)
 	if err != nil {
 		t.Fatalf("Should be able to create resource quota: %v", err)
 	}
-	rq, err = k8s.getResourceQuota("default", "testrq")
+	rq, err = k8s.getResourceQuota(ctx, "default", "testrq")
 	if err != nil {
 		t.Fatalf("Should be able to get resource quota: %v", err)
 	}
@@ -116,11 +609,11 @@ func TestResourceQuotas(t *testing.T) {
 	}
 
 	// update
-	_, err = k8s.setResourceQuota("default", "testrq", q5)
+	_, err = k8s.setResourceQuota(ctx, "default", "testrq", q5)
 	if err != nil {
 		t.Fatalf("Should be able to update resource quota: %v", err)
 	}
-	rq, err = k8s.getResourceQuota("default", "testrq")
+	rq, err = k8s.getResourceQuota(ctx, "default", "testrq")
 	if err != nil {
 		t.Fatalf("Should be able to get resource quota: %v", err)
 	}
@@ -130,16 +623,379 @@ func TestResourceQuotas(t *testing.T) {
 	}
 
 	// delete
-	err = k8s.removeResourceQuota("default", "testrq")
+	err = k8s.removeResourceQuota(ctx, "default", "testrq")
 	if err != nil {
 		t.Fatalf("Should be able to delete resource quota: %v", err)
 	}
-	exists := k8s.hasResourceQuota("default", "testrq")
+	exists := k8s.hasResourceQuota(ctx, "default", "testrq")
 	if exists {
 		t.Fatalf("Resource quota should no longer exist")
 	}
 }
 
+func TestQuotaFor(t *testing.T) {
+	ctx := context.Background()
+	hard := quotaFor(nsConfig{Name: "ns1", Limit: 10}, Specification{})
+	if len(hard) != 1 {
+		t.Fatalf("Expected memory only but was %v", describe(hard))
+	}
+	hard = quotaFor(nsConfig{Name: "ns1", Limit: 10, CPURequest: 2000, CPULimit: 4500}, Specification{})
+	check("limits.cpu=4500m, requests.cpu=2, requests.memory=10Gi", describe(hard), t)
+
+	// quota saved in cluster should match
+	k8s := newTestSimpleK8s()
+	rq, err := k8s.setResourceQuotaHard(ctx, "default", quotaName, hard)
+	if err != nil {
+		t.Fatalf("Should be able to create resource quota: %v", err)
+	}
+	if !sameResources(rq.Spec.Hard, hard) {
+		t.Fatalf("Expected %v but was %v", describe(hard), describe(rq.Spec.Hard))
+	}
+	if sameResources(rq.Spec.Hard, quotaFor(nsConfig{Name: "ns1", Limit: 10, CPURequest: 2000}, Specification{})) {
+		t.Fatal("Quota without CPU limit should be different")
+	}
+}
+
+func TestApplyQuota(t *testing.T) {
+	ctx := context.Background()
+	k8s := newTestSimpleK8s()
+	platform := v1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "platform",
+			Annotations: map[string]string{adoptAnnotation: "true"},
+		},
+		Spec: v1.ResourceQuotaSpec{Hard: v1.ResourceList{
+			v1.ResourceRequestsMemory: resource.MustParse("5Gi"),
+			v1.ResourcePods:           resource.MustParse("20"),
+		}},
+	}
+	k8s.clientset.CoreV1().ResourceQuotas("default").Create(ctx, &platform, metav1.CreateOptions{})
+	quotas, _ := k8s.getResourceQuotas(ctx, "default")
+	adopted := adoptedQuota(quotas)
+	if adopted == nil {
+		t.Fatal("Annotated quota should be adopted")
+	}
+	check("platform", adopted.Name, t)
+
+	// only the memory limit is changed
+	rq, err := k8s.applyResourceQuota(ctx, "default", adopted.Name, quotaFor(nsConfig{Name: "default", Limit: 10}, Specification{}))
+	if err != nil {
+		t.Fatalf("Should be able to apply quota: %v", err)
+	}
+	check("pods=20, requests.memory=10Gi", describe(rq.Spec.Hard), t)
+
+	// applied limits are read from the managed fields
+	rq.ManagedFields = []metav1.ManagedFieldsEntry{{
+		Manager:  fieldManager,
+		FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:spec":{"f:hard":{"f:requests.memory":{}}}}`)},
+	}}
+	check("requests.memory=10Gi", describe(appliedLimits(rq)), t)
+}
+
+func TestConflicts(t *testing.T) {
+	quota := func(name string, adopt bool, hard v1.ResourceList) v1.ResourceQuota {
+		rq := v1.ResourceQuota{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: v1.ResourceQuotaSpec{Hard: hard}}
+		if adopt {
+			rq.Annotations = map[string]string{adoptAnnotation: "true"}
+		}
+		return rq
+	}
+	memory := v1.ResourceList{v1.ResourceMemory: resource.MustParse("5Gi")}
+	pods := v1.ResourceList{v1.ResourcePods: resource.MustParse("20")}
+	quotas := []v1.ResourceQuota{
+		quota(quotaName, false, memory),
+		quota("platform", true, memory),
+		quota("pods", false, pods),
+	}
+	ranges := []v1.LimitRange{
+		{ObjectMeta: metav1.ObjectMeta{Name: limitRangeName}, Spec: v1.LimitRangeSpec{
+			Limits: []v1.LimitRangeItem{limitRangeFor(nsConfig{})},
+		}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "defaults"}, Spec: v1.LimitRangeSpec{
+			Limits: []v1.LimitRangeItem{{Type: v1.LimitTypeContainer, Default: memory}},
+		}},
+	}
+	hard := quotaFor(nsConfig{Limit: 10}, Specification{})
+
+	found := conflicts(quotas, ranges, hard, false)
+	check("ResourceQuota platform sets memory; LimitRange defaults sets container defaults", strings.Join(found, "; "), t)
+
+	// adopted quota is shared in apply mode
+	found = conflicts(quotas, ranges, hard, true)
+	check("LimitRange defaults sets container defaults", strings.Join(found, "; "), t)
+}
+
+func TestMemLimitsQuota(t *testing.T) {
+	spec := Specification{}
+	cfg := nsConfig{Name: "ns1", Limit: 10}
+	if memLimitsQuota(cfg, spec) != nil {
+		t.Fatal("Limits shouldn't be constrained by default")
+	}
+
+	// default ratio, overridden per namespace
+	spec.MemLimitRatio = 2
+	check("limits.memory=20Gi, requests.memory=10Gi", describe(quotaFor(cfg, spec)), t)
+	cfg = withMemLimits(cfg, nil, func(r float64) *float64 { return &r }(1.5))
+	check("15Gi", memLimitsQuota(cfg, spec).String(), t)
+	cfg = withMemLimits(cfg, nil, func(r float64) *float64 { return &r }(0))
+	if memLimitsQuota(cfg, spec) != nil {
+		t.Fatal("Zero ratio should remove limits quota")
+	}
+
+	// set explicitly
+	limits := resource.MustParse("12Gi")
+	cfg = withMemLimits(cfg, &limits, nil)
+	check("12Gi", memLimitsQuota(cfg, spec).String(), t)
+	if validateMemLimits(cfg, spec) != nil {
+		t.Fatal("Limits above requests should be accepted")
+	}
+	limits = resource.MustParse("8Gi")
+	if validateMemLimits(withMemLimits(cfg, &limits, nil), spec) == nil {
+		t.Fatal("Limits below requests should be rejected")
+	}
+}
+
+func TestDeclared(t *testing.T) {
+	spec := Specification{MinMemLimit: 1, MaxMemLimit: 100, AnnotationPrecedence: precedenceAnnotations}
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "ns1", Annotations: map[string]string{
+		startHourAnnotation:   "7",
+		memoryLimitAnnotation: "12Gi",
+		windowAnnotation:      "bad",
+	}}}
+	d, errs := declared(ns, spec)
+	checkInt(1, int64(len(errs)), t)
+	if d.Window != nil {
+		t.Fatal("Invalid window should be ignored")
+	}
+
+	// annotations override the UI, and UI changes are rejected
+	hour := 9
+	cfg := withMemLimit(nsConfig{Name: "ns1", AutoStartHour: &hour}, resource.MustParse("4Gi"))
+	configs := withDeclared(map[string]nsConfig{"ns1": cfg}, map[string]nsState{"ns1": {Name: "ns1", Declared: d}})
+	cfg = configs["ns1"]
+	started, _ := startHour(cfg)
+	checkInt(7, int64(*started), t)
+	check("12Gi", memLimit(cfg).String(), t)
+	checkInt(window*60*60, windowOf(cfg), t)
+	check("annotation annotation default", strings.Join([]string{
+		sources(cfg)["startHour"], sources(cfg)["memoryLimit"], sources(cfg)["window"]}, " "), t)
+	if checkDeclared(cfg, "startHour") == nil {
+		t.Fatal("UI change to annotated start hour should be rejected")
+	}
+
+	// the UI wins when configured, annotations fill in what isn't set
+	spec.AnnotationPrecedence = precedenceUI
+	ns.Annotations[windowAnnotation] = "4h"
+	d, _ = declared(ns, spec)
+	cfg.Declared = &d
+	cfg.Memory = nil
+	started, _ = startHour(cfg)
+	checkInt(9, int64(*started), t)
+	check("12Gi", memLimit(cfg).String(), t)
+	checkInt(4*60*60, windowOf(cfg), t)
+	check("ui annotation annotation", strings.Join([]string{
+		sources(cfg)["startHour"], sources(cfg)["memoryLimit"], sources(cfg)["window"]}, " "), t)
+	if checkDeclared(cfg, "startHour") != nil {
+		t.Fatal("UI changes should be allowed when the UI takes precedence")
+	}
+
+	// annotated namespaces without a config, and nothing saved
+	configs = withDeclared(map[string]nsConfig{}, map[string]nsState{"ns2": {Name: "ns2", Declared: d}})
+	check("12Gi", memLimit(configs["ns2"]).String(), t)
+	saved, _ := toJSON(cfgArray(configs))
+	check(`{"apiVersion":"podreaper.io/v1","items":[{"name":"ns2","autoStartHour":null,"lastStarted":0,"limit":10}]}`, saved, t)
+}
+
+func TestLimitRange(t *testing.T) {
+	ctx := context.Background()
+	k8s := newTestSimpleK8s()
+	k8s.clientset.CoreV1().Namespaces().Create(ctx, &v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "default"},
+		Status:     v1.NamespaceStatus{Phase: v1.NamespaceActive},
+	}, metav1.CreateOptions{})
+	limitRange := func() v1.LimitRangeItem {
+		lr, err := k8s.clientset.CoreV1().LimitRanges("default").
+			Get(ctx, limitRangeName, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("Should be able to get limit range: %v", err)
+		}
+		return lr.Spec.Limits[0]
+	}
+
+	// created with defaults
+	k8s.checkLimitRange(ctx, "default", limitRangeFor(nsConfig{Name: "default"}))
+	item := limitRange()
+	check(podLimit, item.Default.Memory().String(), t)
+
+	// existing limit range updated with overrides
+	cfg := nsConfig{Name: "default", LimitRange: &limitRangeConfig{
+		Default: v1.ResourceList{v1.ResourceMemory: resource.MustParse("2Gi")},
+		Max:     v1.ResourceList{v1.ResourceMemory: resource.MustParse("8Gi")},
+	}}
+	k8s.checkLimitRange(ctx, "default", limitRangeFor(cfg))
+	item = limitRange()
+	check("2Gi", item.Default.Memory().String(), t)
+	check("8Gi", item.Max.Memory().String(), t)
+	check(podCPULimit, item.Default.Cpu().String(), t)
+}
+
+func TestStorage(t *testing.T) {
+	ctx := context.Background()
+	requests := resource.MustParse("100Gi")
+	hard := quotaFor(nsConfig{Name: "ns1", Limit: 10, Storage: &storageConfig{
+		Requests: &requests,
+		Claims:   5,
+		Classes:  map[string]resource.Quantity{"fast": resource.MustParse("20Gi")},
+	}}, Specification{})
+	check("fast.storageclass.storage.k8s.io/requests.storage=20Gi, "+
+		"persistentvolumeclaims=5, requests.memory=10Gi, requests.storage=100Gi", describe(hard), t)
+
+	k8s := newTestSimpleK8s()
+	fast := "fast"
+	for i, class := range []*string{&fast, nil} {
+		k8s.clientset.CoreV1().PersistentVolumeClaims("default").Create(ctx,
+			&v1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pvc%v", i)},
+				Spec: v1.PersistentVolumeClaimSpec{
+					StorageClassName: class,
+					Resources: v1.ResourceRequirements{Requests: v1.ResourceList{
+						v1.ResourceStorage: resource.MustParse("1Gi"),
+					}},
+				},
+			}, metav1.CreateOptions{})
+	}
+	usage, err := k8s.getStorageUsage(ctx, "default")
+	if err != nil {
+		t.Fatalf("Should be able to get storage usage: %v", err)
+	}
+	checkInt(2*bytesInGi, usage.Requests, t)
+	checkInt(2, int64(usage.Claims), t)
+	checkInt(bytesInGi, usage.Classes["fast"], t)
+}
+
+func TestBarePods(t *testing.T) {
+	ctx := context.Background()
+	k8s := newTestSimpleK8s()
+	pods := k8s.clientset.CoreV1().Pods("default")
+	recreate := map[string]string{recreateAnnotation: "true"}
+	bare := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "debug", Annotations: recreate},
+		Spec: v1.PodSpec{
+			NodeName:   "node1",
+			Containers: []v1.Container{{Name: "shell", Image: "busybox"}},
+		},
+	}
+	owned := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "owned",
+			Annotations:     recreate,
+			OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "rs"}},
+		},
+	}
+	other := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "other"}}
+	for _, pod := range []*v1.Pod{bare, owned, other} {
+		pods.Create(ctx, pod, metav1.CreateOptions{})
+	}
+
+	// only the annotated bare pod should be saved
+	err := k8s.snapshotBarePods(ctx, "default")
+	if err != nil {
+		t.Fatalf("Should be able to save bare pods: %v", err)
+	}
+	cm, err := k8s.clientset.CoreV1().ConfigMaps("default").
+		Get(ctx, podsConfigMapName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Should be able to get saved pods: %v", err)
+	}
+	if len(cm.Data) != 1 || cm.Data["debug"] == "" {
+		t.Fatalf("Expected only debug pod to be saved but was %v", cm.Data)
+	}
+
+	// recreate after the pods have been deleted
+	for _, pod := range []*v1.Pod{bare, owned, other} {
+		pods.Delete(ctx, pod.Name, metav1.DeleteOptions{})
+	}
+	err = k8s.restoreBarePods(ctx, "default")
+	if err != nil {
+		t.Fatalf("Should be able to recreate bare pods: %v", err)
+	}
+	restored, err := pods.Get(ctx, "debug", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Debug pod should have been recreated: %v", err)
+	}
+	if restored.Spec.NodeName != "" {
+		t.Fatalf("Node name should be cleared but was %v", restored.Spec.NodeName)
+	}
+	if _, err := pods.Get(ctx, "owned", metav1.GetOptions{}); err == nil {
+		t.Fatal("Owned pod should not be recreated")
+	}
+	_, err = k8s.clientset.CoreV1().ConfigMaps("default").
+		Get(ctx, podsConfigMapName, metav1.GetOptions{})
+	if err == nil {
+		t.Fatal("Saved pods should be removed after recreating")
+	}
+
+	// a snapshot from an earlier stop is removed when there's nothing to save
+	k8s.snapshotBarePods(ctx, "default")
+	pods.Delete(ctx, "debug", metav1.DeleteOptions{})
+	if err := k8s.snapshotBarePods(ctx, "default"); err != nil {
+		t.Fatalf("Should be able to remove saved pods: %v", err)
+	}
+	_, err = k8s.clientset.CoreV1().ConfigMaps("default").Get(ctx, podsConfigMapName, metav1.GetOptions{})
+	if !errors.IsNotFound(err) {
+		t.Fatalf("Stale saved pods should be removed, but got %v", err)
+	}
+
+	// errors other than the snapshot not existing aren't hidden by creating it
+	pods.Create(ctx, bare, metav1.CreateOptions{})
+	k8s.clientset.(*fake.Clientset).PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.NewForbidden(v1.Resource("configmaps"), podsConfigMapName, fmt.Errorf("denied"))
+	})
+	if err := k8s.snapshotBarePods(ctx, "default"); !errors.IsForbidden(err) {
+		t.Fatalf("Expected forbidden error but was %v", err)
+	}
+}
+
+func TestScaleWorkloads(t *testing.T) {
+	k8s := newTestSimpleK8s()
+	ctx := context.Background()
+	three := int32(3)
+	deployments := k8s.clientset.AppsV1().Deployments("default")
+	deployments.Create(ctx, &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web"},
+		Spec:       appsv1.DeploymentSpec{Replicas: &three},
+	}, metav1.CreateOptions{})
+	cronJobs := k8s.clientset.BatchV1().CronJobs("default")
+	cronJobs.Create(ctx, &batchv1.CronJob{ObjectMeta: metav1.ObjectMeta{Name: "job"}}, metav1.CreateOptions{})
+
+	// scale down
+	err := k8s.scaleDownWorkloads(ctx, "default")
+	if err != nil {
+		t.Fatalf("Should be able to scale down: %v", err)
+	}
+	d, _ := deployments.Get(ctx, "web", metav1.GetOptions{})
+	checkInt(0, int64(*d.Spec.Replicas), t)
+	cj, _ := cronJobs.Get(ctx, "job", metav1.GetOptions{})
+	if !*cj.Spec.Suspend {
+		t.Fatal("Cron job should be suspended")
+	}
+
+	// restore
+	err = k8s.restoreWorkloads(ctx, "default")
+	if err != nil {
+		t.Fatalf("Should be able to restore: %v", err)
+	}
+	d, _ = deployments.Get(ctx, "web", metav1.GetOptions{})
+	checkInt(3, int64(*d.Spec.Replicas), t)
+	if _, ok := d.Annotations[replicasAnnotation]; ok {
+		t.Fatal("Replicas annotation should be removed")
+	}
+	cj, _ = cronJobs.Get(ctx, "job", metav1.GetOptions{})
+	if *cj.Spec.Suspend {
+		t.Fatal("Cron job should be resumed")
+	}
+}
+
 func TestRemaining(t *testing.T) {
 	start := time.Now().Unix() // unix time in seconds (int64)
 	m := int64(60)             // seconds in minute
@@ -157,8 +1013,27 @@ func TestRemaining(t *testing.T) {
 	check("", rem(start, start-20*m), t)
 }
 
+func TestTimings(t *testing.T) {
+	s := newTestState()
+	s.Spec.WarningPeriod = 15 * time.Minute
+	now := time.Now()
+	cfg := nsConfig{Name: "ns1", LastStarted: now.Unix() - window*60*60 + 10*60}
+
+	state := withTimings(nsState{Name: "ns1"}, cfg, now.Add(-time.Hour), s)
+	check("1h 10m", state.Remaining, t)
+	if state.StoppingSoon {
+		t.Fatal("Namespace shouldn't be stopping soon before the warning period")
+	}
+	state = withTimings(state, cfg, now, s)
+	check("10m", state.Remaining, t)
+	check(formatTime(now.Unix()+10*60, time.UTC), state.StopsAt, t)
+	if !state.StoppingSoon {
+		t.Fatal("Namespace should be stopping soon in the warning period")
+	}
+}
+
 func rem(start int64, stop int64) string {
-	return remaining(remainingSeconds(start, stop))
+	return remaining(remainingSeconds(start, stop, window*60*60), window*60*60)
 }
 
 func check(expected string, actual string, t *testing.T) {
@@ -196,6 +1071,16 @@ func TestAutoStart(t *testing.T) {
 	lschedString = toString(time.Unix(lsched, 0).In(zone))
 	check("2019-11-13T17:00:00+08:00", lschedString, t)
 
+	// check nextScheduled
+	hour = 20
+	check("2019-11-14T20:00:00+08:00", formatTime(nextScheduled(&hour, wedAfter8pm), zone), t)
+	hour = 21
+	check("2019-11-13T21:00:00+08:00", formatTime(nextScheduled(&hour, wedAfter8pm), zone), t)
+	fri9pm := toTime("2019-11-15T21:00:00+08:00", t)
+	hour = 9
+	check("2019-11-18T09:00:00+08:00", formatTime(nextScheduled(&hour, fri9pm.In(zone)), zone), t)
+	checkInt(0, nextScheduled(nil, wedAfter8pm), t)
+
 	// check hoursFrom
 	checkInt(0, hoursFrom(started, wedAfter8pm.Unix()), t)
 	checkInt(3, hoursFrom(lsched, wedAfter8pm.Unix()), t)
@@ -212,3 +1097,374 @@ func toTime(value string, t *testing.T) time.Time {
 func toString(value time.Time) string {
 	return value.Format(time.RFC3339)
 }
+
+func TestExtendPolicy(t *testing.T) {
+	spec := Specification{ExtendMinSinceStart: time.Hour, ExtendStopped: true}
+	now := toTime("2019-11-13T20:00:00+08:00", t)
+	running := nsState{Name: "ns1"}
+	cfg := nsConfig{Name: "ns1", Phase: phaseRunning, LastStarted: now.Unix() - 30*60}
+	allowed := func(cfg nsConfig, state nsState) bool {
+		return checkExtend(policyFor(cfg, spec), cfg, state, now) == nil
+	}
+
+	// must be running for an hour unless about to stop
+	if allowed(cfg, running) {
+		t.Fatal("Should not extend within an hour of starting")
+	}
+	if !allowed(cfg, nsState{Name: "ns1", StoppingSoon: true}) {
+		t.Fatal("Should always extend when stopping soon")
+	}
+	cfg.LastStarted = now.Unix() - 2*60*60
+	if !allowed(cfg, running) {
+		t.Fatal("Should extend after running for an hour")
+	}
+
+	// per namespace overrides
+	maxRemaining := int64(60 * 60)
+	cfg.ExtendPolicy = &extendPolicy{MaxRemaining: &maxRemaining}
+	if allowed(cfg, running) {
+		t.Fatal("Should not extend with more than an hour remaining")
+	}
+	maxPerDay := 1
+	cfg.ExtendPolicy = &extendPolicy{MaxPerDay: &maxPerDay}
+	if !allowed(cfg, running) {
+		t.Fatal("Should extend when not yet extended today")
+	}
+	cfg = recordExtend(cfg, now)
+	if allowed(cfg, running) {
+		t.Fatal("Should not extend more than once per day")
+	}
+	tomorrow := now.AddDate(0, 0, 1)
+	if checkExtend(policyFor(cfg, spec), cfg, running, tomorrow) != nil {
+		t.Fatal("Extend count should reset the next day")
+	}
+
+	// stopped namespaces
+	allowStopped := false
+	stopped := nsConfig{Name: "ns1", Phase: phaseStopped}
+	if !allowed(stopped, running) {
+		t.Fatal("Should be able to start stopped namespace by default")
+	}
+	stopped.ExtendPolicy = &extendPolicy{AllowStopped: &allowStopped}
+	if allowed(stopped, running) {
+		t.Fatal("Should not start stopped namespace when not allowed")
+	}
+}
+
+func TestValidation(t *testing.T) {
+	spec := Specification{MinMemLimit: 10, MaxMemLimit: 100}
+	for _, limit := range []string{"0", "-10Gi", "9.5Gi", "110Gi"} {
+		if validateLimit(resource.MustParse(limit), spec) == nil {
+			t.Fatalf("Limit %v outside range should be rejected", limit)
+		}
+	}
+	for _, limit := range []string{"10Gi", "12.5Gi", "100Gi"} {
+		if validateLimit(resource.MustParse(limit), spec) != nil {
+			t.Fatalf("Limit %v within range should be accepted", limit)
+		}
+	}
+	hour := 24
+	if validateStartHour(&hour) == nil {
+		t.Fatal("Start hour 24 should be rejected")
+	}
+	if validateStartHour(nil) != nil {
+		t.Fatal("Start hour can be empty")
+	}
+	if validateCPU(2000, 1000) == nil {
+		t.Fatal("CPU request more than limit should be rejected")
+	}
+
+	// defaults are used when checking limit range order
+	lr := &limitRangeConfig{Max: v1.ResourceList{v1.ResourceMemory: resource.MustParse("256Mi")}}
+	if validateLimitRange(lr, nsConfig{}) == nil {
+		t.Fatal("Max less than default limit should be rejected")
+	}
+	lr = &limitRangeConfig{Max: v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Gi")}}
+	if validateLimitRange(lr, nsConfig{}) == nil {
+		t.Fatal("Only memory and cpu should be allowed")
+	}
+
+	// errors are returned as JSON
+	w := httptest.NewRecorder()
+	writeError(w, validateLimit(gibibytes(0), spec))
+	checkInt(http.StatusBadRequest, int64(w.Code), t)
+	check(`{"status":400,"error":"memory limit must be from 10Gi to 100Gi"}`, w.Body.String(), t)
+}
+
+// State for running the status loop against a fake cluster, with ticks
+// and saves that don't happen during a test
+func newTestState() state {
+	spec := Specification{
+		ConfigMapNamespace: defaultNamespace,
+		ConfigMapName:      testConfigMap.Name,
+		ClockTick:          time.Hour,
+		ReaperTick:         time.Hour,
+		NamespaceTick:      time.Hour,
+		SaveDelay:          time.Hour,
+	}
+	return newState(spec, *time.UTC, *newTestSimpleK8s())
+}
+
+// Run the status loop until the returned function is called
+func runStatus(s state) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		maintainStatus(ctx, s)
+		close(done)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func TestFinalSave(t *testing.T) {
+	s := newTestState()
+	stop := runStatus(s)
+	s.updateNsConfig <- nsConfig{Name: "ns1", Limit: 20}
+	stop()
+
+	saved, err := s.store.load(context.Background())
+	if err != nil || len(saved) != 1 || saved[0].Limit != 20 {
+		t.Fatalf("Pending change should be saved when stopping, but was %v (%v)", saved, err)
+	}
+}
+
+func TestForward(t *testing.T) {
+	local := func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "local") }
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "leader "+r.Header.Get(forwardedHeader))
+	}))
+	defer leader.Close()
+	request := func(l *leadership, forwarded bool) (int, string) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/reaper/extend", strings.NewReader("{}"))
+		if forwarded {
+			r.Header.Set(forwardedHeader, "true")
+		}
+		forward(l, local)(w, r)
+		return w.Code, w.Body.String()
+	}
+
+	// handled locally without leader election
+	_, body := request(newLeadership(false), false)
+	check("local", body, t)
+
+	// rejected until there's a leader
+	follower := newLeadership(true)
+	code, _ := request(follower, false)
+	checkInt(http.StatusServiceUnavailable, int64(code), t)
+
+	// forwarded to the leader, but only once
+	follower.leader.Store(strings.TrimPrefix(leader.URL, "http://"))
+	_, body = request(follower, false)
+	check("leader true", body, t)
+	code, _ = request(follower, true)
+	checkInt(http.StatusServiceUnavailable, int64(code), t)
+}
+
+func TestBudget(t *testing.T) {
+	configs := map[string]nsConfig{
+		"ns1": {Name: "ns1", Limit: 20, Phase: phaseRunning},
+		"ns2": {Name: "ns2", Limit: 30, Phase: phaseStopped},
+	}
+	states := map[string]nsState{
+		"ns1": {Name: "ns1"},
+		"ns2": {Name: "ns2", HasDownQuota: true},
+		"ns3": {Name: "ns3"}, // no config, uses default limit
+	}
+	checkInt(30*bytesInGi, usedBudget(configs, states, ""), t)
+	checkInt(10*bytesInGi, usedBudget(configs, states, "ns1"), t)
+
+	budget := newBudget(25*bytesInGi, usedBudget(configs, states, ""))
+	checkInt(0, budget.Available.Bytes, t)
+	check("30Gi", budget.Used.Formatted, t)
+
+	// whole Gi in the status
+	var current status
+	json.Unmarshal([]byte(updateStatus(configs, states, "", 25*bytesInGi+bytesInGi/2, nil, newTestState())), &current)
+	checkInt(25, int64(current.Total), t)
+	checkInt(30, int64(current.Used), t)
+	checkInt(0, int64(current.Available), t)
+}
+
+func TestUpdateWithinBudget(t *testing.T) {
+	s := newTestState()
+	stop := runStatus(s)
+	defer stop()
+	s.updateBudget <- 25 * bytesInGi
+	s.updateNsConfig <- nsConfig{Name: "ns1", Limit: 10}
+	s.updateNsConfig <- nsConfig{Name: "ns2", Limit: 10}
+	s.updateNsState <- nsState{Name: "ns1"}
+	s.updateNsState <- nsState{Name: "ns2"}
+
+	// the first change uses up the budget the second one needed
+	if err := s.updateWithinBudget(nsConfig{Name: "ns1", Limit: 15}); err != nil {
+		t.Fatal(err)
+	}
+	if s.updateWithinBudget(nsConfig{Name: "ns2", Limit: 15}) == nil {
+		t.Fatal("Change over the budget should be rejected")
+	}
+	checkInt(15, int64(s.getConfigFor("ns1").Limit), t)
+	checkInt(10, int64(s.getConfigFor("ns2").Limit), t)
+
+	// decreasing is always allowed
+	if err := s.updateWithinBudget(nsConfig{Name: "ns2", Limit: 5}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImportWithinBudget(t *testing.T) {
+	s := newTestState()
+	stop := runStatus(s)
+	defer stop()
+	s.updateBudget <- 25 * bytesInGi
+	s.updateNsConfig <- nsConfig{Name: "ns1", Limit: 10}
+	s.updateNsConfig <- nsConfig{Name: "ns2", Limit: 10}
+	s.updateNsState <- nsState{Name: "ns1"}
+	s.updateNsState <- nsState{Name: "ns2"}
+
+	// nothing is imported if the limits don't fit in the budget together
+	imported, _ := parseConfigs([]byte("- name: ns1\n  limit: 12\n- name: ns2\n  limit: 15\n"))
+	changes := planImport(s.configMap(), imported, importMerge)
+	if importChanges(changes, false, s) == nil {
+		t.Fatal("Import over the budget should be rejected")
+	}
+	checkInt(10, int64(s.getConfigFor("ns1").Limit), t)
+	if err := importChanges(changes, true, s); err != nil {
+		t.Fatalf("Dry run shouldn't be checked against the budget: %v", err)
+	}
+
+	// settings set by annotations can't be imported
+	twelve := resource.MustParse("12Gi")
+	s.updateNsState <- nsState{Name: "ns1", Declared: declaredConfig{Memory: &twelve, Override: true}}
+	imported, _ = parseConfigs([]byte("- name: ns1\n  limit: 11\n"))
+	if importChanges(planImport(s.configMap(), imported, importMerge), false, s) == nil {
+		t.Fatal("Import of an annotated setting should be rejected")
+	}
+}
+
+func TestRollbackWithinBudget(t *testing.T) {
+	s := newTestState()
+	stop := runStatus(s)
+	defer stop()
+	s.updateBudget <- 25 * bytesInGi
+	s.updateNsConfig <- nsConfig{Name: "ns1", Limit: 10}
+	s.updateNsConfig <- nsConfig{Name: "ns2", Limit: 10}
+	s.updateNsState <- nsState{Name: "ns1"}
+	s.updateNsState <- nsState{Name: "ns2"}
+	rev := revision{Revision: 1, Configs: []nsConfig{{Name: "ns1", Limit: 12}, {Name: "ns2", Limit: 15}}}
+
+	// nothing is rolled back if the limits don't fit in the budget together
+	if rollback([]string{"ns1", "ns2"}, rev, s) == nil {
+		t.Fatal("Rollback over the budget should be rejected")
+	}
+	checkInt(10, int64(s.getConfigFor("ns1").Limit), t)
+	if err := rollback([]string{"ns1"}, rev, s); err != nil {
+		t.Fatal(err)
+	}
+	checkInt(12, int64(s.getConfigFor("ns1").Limit), t)
+
+	// settings set by annotations can't be rolled back
+	hour := 7
+	s.updateNsState <- nsState{Name: "ns2", Declared: declaredConfig{StartHour: &hour, Override: true}}
+	rev.Configs[1] = nsConfig{Name: "ns2", Limit: 10, AutoStartHour: &hour}
+	if rollback([]string{"ns2"}, rev, s) == nil {
+		t.Fatal("Rollback of an annotated setting should be rejected")
+	}
+}
+
+func TestDeclaredBudget(t *testing.T) {
+	s := newTestState()
+	stop := runStatus(s)
+	defer stop()
+	s.updateBudget <- 25 * bytesInGi
+	s.updateNsConfig <- nsConfig{Name: "ns1", Limit: 20}
+	s.updateNsState <- nsState{Name: "ns1"}
+
+	over := resource.MustParse("30Gi")
+	declared := declaredConfig{Memory: &over, Override: true}
+	if checkDeclaredBudget("ns1", &declared, s) == nil || declared.Memory != nil {
+		t.Fatal("Declared limit over the budget should be ignored")
+	}
+	within := resource.MustParse("24Gi")
+	declared.Memory = &within
+	if err := checkDeclaredBudget("ns1", &declared, s); err != nil || declared.Memory == nil {
+		t.Fatalf("Declared limit within the budget should be kept: %v", err)
+	}
+
+	// and uses the budget straight away
+	s.updateNsConfig <- nsConfig{Name: "ns2", Limit: 1}
+	s.updateNsState <- nsState{Name: "ns2"}
+	if s.updateWithinBudget(nsConfig{Name: "ns2", Limit: 2}) == nil {
+		t.Fatal("Budget used by the declared limit should be taken into account")
+	}
+}
+
+func TestAllocatableMemory(t *testing.T) {
+	ctx := context.Background()
+	k8s := newTestSimpleK8s()
+	for _, name := range []string{"node1", "node2"} {
+		k8s.clientset.CoreV1().Nodes().Create(ctx, &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Status: v1.NodeStatus{Allocatable: v1.ResourceList{
+				v1.ResourceMemory: resource.MustParse("16Gi"),
+			}},
+		}, metav1.CreateOptions{})
+	}
+	allocatable, err := k8s.getAllocatableMemory(ctx)
+	if err != nil {
+		t.Fatalf("Should be able to get allocatable memory: %v", err)
+	}
+	checkInt(32*bytesInGi, allocatable, t)
+}
+
+func TestStartQueue(t *testing.T) {
+	gi := func(n int64) int64 { return n * bytesInGi }
+	queue := startQueue{}
+	cfgs := map[string]nsConfig{
+		"ns1": {Name: "ns1", Limit: 20},
+		"ns2": {Name: "ns2", Limit: 10},
+		"ns3": {Name: "ns3", Limit: 10, Priority: 1},
+	}
+
+	// not enough capacity for first in line, so nothing starts
+	admitted := queue.admit(map[string]nsConfig{"ns1": cfgs["ns1"]}, newBudget(gi(100), gi(90)), 100)
+	checkInt(0, int64(len(admitted)), t)
+	admitted = queue.admit(cfgs, newBudget(gi(100), gi(95)), 200)
+	checkInt(0, int64(len(admitted)), t)
+	check("ns3,ns1,ns2", strings.Join(queue.order(cfgs), ","), t)
+	checkInt(2, int64(queuePosition(queue.order(cfgs), "ns1")), t)
+
+	// start in order as capacity frees up
+	admitted = queue.admit(cfgs, newBudget(gi(100), gi(70)), 300)
+	checkInt(2, int64(len(admitted)), t)
+	checkInt(100, admitted["ns1"], t)
+	check("ns2", strings.Join(queue.order(cfgs), ","), t)
+
+	// everything starts if budget isn't known
+	admitted = queue.admit(cfgs, newBudget(0, 0), 400)
+	checkInt(3, int64(len(admitted)), t)
+	checkInt(0, int64(len(queue)), t)
+}
+
+func TestMemory(t *testing.T) {
+	check("700Mi", formatMemory(700*1024*1024), t)
+	check("2.5Gi", formatMemory(5*bytesInGi/2), t)
+	check("10Gi", formatMemory(10*bytesInGi), t)
+	check("0", formatMemory(0), t)
+
+	// never rounded
+	check("2304Mi", formatMemory(9*bytesInGi/4), t)
+	check("2007Mi", formatMemory(2007*bytesInMi), t)
+	check("1025Ki", formatMemory(1025*1024), t)
+
+	// whole Gi limits from older configs
+	legacy := nsConfig{Name: "ns1", Limit: 20}
+	check("20Gi", memLimit(legacy).String(), t)
+
+	cfg := withMemLimit(legacy, resource.MustParse("2560Mi"))
+	check("2560Mi", memLimit(cfg).String(), t)
+	checkInt(2, int64(cfg.Limit), t)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// version of the settings saved in the ConfigMap, older versions are
+// migrated when loaded
+const settingsVersion = "podreaper.io/v1"
+
+// Saved settings, with the version of their schema
+type settingsEnvelope struct {
+	APIVersion string          `json:"apiVersion"`
+	Items      json.RawMessage `json:"items"`
+}
+
+// Changes the items of one version of the settings into the next
+type settingsMigration struct {
+	from    string
+	to      string
+	migrate func(items []map[string]interface{}) []map[string]interface{}
+}
+
+// Every migration in order, from the unversioned array saved by earlier
+// versions of the reaper to the current version
+var settingsMigrations = []settingsMigration{
+	{from: "", to: settingsVersion, migrate: memoryFromLimit},
+}
+
+func toJSON(settings []nsConfig) (string, error) {
+	items, err := json.Marshal(settings)
+	if err != nil {
+		return "", err
+	}
+	result, err := json.Marshal(settingsEnvelope{APIVersion: settingsVersion, Items: items})
+	return string(result), err
+}
+
+// Read saved settings of any version, migrating them to the current one
+func fromJSON(data string) ([]nsConfig, error) {
+	envelope := settingsEnvelope{}
+	if bytes.HasPrefix(bytes.TrimSpace([]byte(data)), []byte("[")) {
+		envelope.Items = json.RawMessage(data) // unversioned array
+	} else if err := json.Unmarshal([]byte(data), &envelope); err != nil {
+		return nil, err
+	}
+	items := []map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(envelope.Items))
+	decoder.UseNumber() // keep timestamps exact
+	if err := decoder.Decode(&items); err != nil {
+		return nil, err
+	}
+	version := envelope.APIVersion
+	for _, m := range settingsMigrations {
+		if m.from == version {
+			items = m.migrate(items)
+			version = m.to
+		}
+	}
+	if version != settingsVersion {
+		return nil, fmt.Errorf("unsupported settings version '%v'", envelope.APIVersion)
+	}
+	result := []nsConfig{}
+	migrated, err := json.Marshal(items)
+	if err == nil {
+		err = json.Unmarshal(migrated, &result)
+	}
+	return result, err
+}
+
+// Settings from before sub-Gi memory limits only have a whole Gi limit
+func memoryFromLimit(items []map[string]interface{}) []map[string]interface{} {
+	for _, item := range items {
+		if _, ok := item["memory"]; ok {
+			continue
+		}
+		if limit, ok := item["limit"].(json.Number); ok {
+			item["memory"] = limit.String() + "Gi"
+		}
+	}
+	return items
+}
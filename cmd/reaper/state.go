@@ -2,25 +2,39 @@ package main
 
 import (
 	"time"
+
+	"k8s.io/client-go/util/workqueue"
 )
 
 type state struct {
 	Spec     Specification
 	timeZone time.Location
-	cluster  k8s // access to the cluster
+	cluster  k8s           // access to the cluster
+	leader   *leadership   // whether this replica makes changes
+	store    configStore   // where namespace configs are saved
+	history  configHistory // previous versions of the configs
 
 	// changes and updates
-	triggerNs      chan string   // signal that namespace needs to be updated
-	updateNsState  chan nsState  // signal namespace updated
-	updateNsConfig chan nsConfig // signal namepsace config updated
+	changed        workqueue.Interface // namespaces that need to be updated
+	updateNsState  chan nsState        // signal namespace updated
+	updateNsConfig chan nsConfig       // signal namepsace config updated
+	updateLimit    chan limitUpdate    // signal namespace configs updated if they fit the budget
+	updateDeclared chan declaredUpdate // signal declared settings updated if they fit the budget
+	updateBudget   chan int64          // signal cluster memory budget updated
+	updateQueue    chan []string       // signal start queue updated
 
 	// signal namespace removal
-	rmNamespace chan string
+	rmNamespace  chan string
+	rmTombstones chan string // remove kept configs of a deleted namespace, or all if empty
+
+	// signal configs changed in the store by others
+	storeChanged chan struct{}
 
 	// getting data
 	getStatus  chan string     // get the current status JSON
 	getConfigs chan []nsConfig // get the current namespace configs
 	getStates  chan []nsState  // get cached namespace state
+	getBudget  chan int64      // get the cluster memory budget in bytes
 }
 
 func newState(spec Specification, tz time.Location, cluster k8s) state {
@@ -28,17 +42,50 @@ func newState(spec Specification, tz time.Location, cluster k8s) state {
 		Spec:           spec,
 		timeZone:       tz,
 		cluster:        cluster,
-		triggerNs:      make(chan string),
+		leader:         newLeadership(spec.LeaderElection),
+		store:          newConfigStore(spec, cluster),
+		history:        newConfigHistory(spec, cluster),
+		changed:        workqueue.New(),
 		rmNamespace:    make(chan string),
+		rmTombstones:   make(chan string),
+		storeChanged:   make(chan struct{}, 1),
 		updateNsState:  make(chan nsState),
 		updateNsConfig: make(chan nsConfig),
+		updateLimit:    make(chan limitUpdate),
+		updateDeclared: make(chan declaredUpdate),
+		updateBudget:   make(chan int64),
+		updateQueue:    make(chan []string),
 		getStatus:      make(chan string),
 		getConfigs:     make(chan []nsConfig),
 		getStates:      make(chan []nsState),
+		getBudget:      make(chan int64),
 	}
 	return s
 }
 
+// Namespace configs with changed memory limits, only updated if they all fit
+// in the budget, with the result of the check sent back
+type limitUpdate struct {
+	configs []nsConfig
+	result  chan error
+}
+
+// Settings declared by the annotations of a namespace, only recorded in its
+// state if the memory limit fits in the budget, with the result sent back
+type declaredUpdate struct {
+	name     string
+	declared declaredConfig
+	result   chan error
+}
+
+// Update namespace configs if their memory limits fit in the budget, none of
+// them are updated if they don't
+func (s state) updateWithinBudget(cfgs ...nsConfig) error {
+	result := make(chan error, 1)
+	s.updateLimit <- limitUpdate{configs: cfgs, result: result}
+	return <-result
+}
+
 func (s state) getConfigFor(ns string) nsConfig {
 	configs := <-s.getConfigs
 	for _, cfg := range configs {
@@ -53,6 +100,16 @@ func (s state) getConfigFor(ns string) nsConfig {
 	}
 }
 
+// cached state of a namespace, false if it hasn't been loaded
+func (s state) getStateFor(ns string) (nsState, bool) {
+	for _, state := range <-s.getStates {
+		if state.Name == ns {
+			return state, true
+		}
+	}
+	return nsState{}, false
+}
+
 // copy the config map for consumers
 func (s state) configMap() map[string]nsConfig {
 	result := map[string]nsConfig{}
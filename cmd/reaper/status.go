@@ -1,61 +1,224 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"sort"
 	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
 )
 
 // Maintain the status JSON that is served to clients
-func maintainStatus(s state) {
+func maintainStatus(ctx context.Context, s state) {
 	now := time.Now().In(&s.timeZone).Format(timeFormat)
-	configs := loadConfigs(s)
+	configs, _ := loadConfigs(ctx, s)
 	configsChanged := false
 	states := map[string]nsState{}
-	clockTick := time.Tick(s.Spec.ClockTick) // trigger clock updates
-	cfgTick := time.Tick(s.Spec.ReaperTick)  // trigger config saves
+	budget := int64(0)
+	queue := []string{}
+	clockTick := time.NewTicker(s.Spec.ClockTick)  // trigger clock updates
+	cfgTick := time.NewTicker(s.Spec.ReaperTick)   // trigger config saves
+	nsTick := time.NewTicker(s.Spec.NamespaceTick) // trigger time remaining updates
+	defer clockTick.Stop()
+	defer nsTick.Stop()
+	defer cfgTick.Stop()
+	leading := s.leader.isLeader()
+	save := func(ctx context.Context) {
+		saved, err := s.store.save(ctx, cfgArray(configs))
+		if err != nil {
+			log.Printf("Unable to save configs: %v", err)
+			return
+		}
+		for name, cfg := range configsByName(saved) {
+			if old, ok := configs[name]; !ok || !sameJSON(old, cfg) {
+				s.changed.Add(name) // changed by others, e.g. a schedule edited with kubectl
+			}
+		}
+		configs = configsByName(saved)
+		if configsChanged {
+			log.Printf("Configs saved")
+		}
+		configsChanged = false
+		if err := s.history.record(ctx, saved, time.Now()); err != nil {
+			log.Printf("Unable to record config revision: %v", err)
+		}
+	}
+
+	reload := func() {
+		if loaded, err := loadConfigs(ctx, s); err == nil {
+			configs = loaded
+			configsChanged = false
+			leading = s.leader.isLeader()
+		}
+	}
+
+	// changes are saved soon after they're made, together with any others
+	// made in the meantime
+	var saveTimer <-chan time.Time
+	changed := func() {
+		configsChanged = true
+		if saveTimer == nil {
+			saveTimer = time.After(s.Spec.SaveDelay)
+		}
+	}
+	update := func(config nsConfig) {
+		config.Declared = nil // only kept in the namespace state
+		configs[config.Name] = config
+		changed()
+		s.changed.Add(config.Name)
+	}
 
 	for {
 		select {
+		// save any pending changes before stopping
+		case <-ctx.Done():
+			if configsChanged && s.leader.isLeader() {
+				save(context.Background())
+			}
+			return
+
 		// send the current status to client
-		case s.getStatus <- updateStatus(configs, states, now):
+		case s.getStatus <- updateStatus(withDeclared(configs, states), states, now, budget, queue, s):
 
 		// update the time displayed in web UI
-		case <-clockTick:
+		case <-clockTick.C:
 			newTime := time.Now().In(&s.timeZone).Format(timeFormat)
 			if newTime != now {
 				now = newTime
 			}
 
+		// the time remaining changes without anything in the cluster
+		// changing, namespaces are only updated when they start or stop
+		// being about to stop to set the warning annotation
+		case <-nsTick.C:
+			current := withDeclared(configs, states)
+			for name, state := range states {
+				cfg, ok := current[name]
+				if !ok {
+					cfg = nsConfig{Name: name, Limit: defaultLimit}
+				}
+				updated := withTimings(state, cfg, time.Now(), s)
+				if updated.StoppingSoon != state.StoppingSoon {
+					s.changed.Add(name)
+				}
+				states[name] = updated
+			}
+
 		case state := <-s.updateNsState:
 			states[state.Name] = state
+			if cfg, ok := configs[state.Name]; ok && cfg.Deleted != 0 {
+				log.Printf("Restoring config of recreated namespace %v", state.Name)
+				configs[state.Name] = restored(nsConfig{Name: state.Name}, cfg)
+				changed()
+			}
+
+		case budget = <-s.updateBudget:
+
+		case queue = <-s.updateQueue:
 
 		case config := <-s.updateNsConfig:
-			configs[config.Name] = config
-			configsChanged = true
+			update(config)
 
-		// remove namespaces if required
+		// checked and updated together, so no other change can use the
+		// same budget in between
+		case limit := <-s.updateLimit:
+			var err error
+			current := withDeclared(configs, states)
+			for _, config := range limit.configs {
+				if err = fitsBudget(config, current, states, budget); err != nil {
+					break
+				}
+				current[config.Name] = config
+			}
+			if err == nil {
+				for _, config := range limit.configs {
+					update(config)
+				}
+			}
+			limit.result <- err
+
+		// checked and recorded together, so a limit changed in the UI
+		// can't use the same budget in between
+		case change := <-s.updateDeclared:
+			current := withDeclared(configs, states)
+			cfg, ok := current[change.name]
+			if !ok {
+				cfg = nsConfig{Name: change.name, Limit: defaultLimit}
+			}
+			cfg.Declared = &change.declared
+			err := fitsBudget(cfg, current, states, budget)
+			if state, ok := states[change.name]; ok && err == nil {
+				state.Declared = change.declared
+				states[change.name] = state
+			}
+			change.result <- err
+
+		// remove namespaces if required, keeping their configs in case
+		// they're created again
 		case ns := <-s.rmNamespace:
-			delete(configs, ns)
 			delete(states, ns)
-			configsChanged = true
+			if cfg, ok := configs[ns]; ok && s.Spec.TombstoneRetention > 0 {
+				log.Printf("Keeping config of deleted namespace %v for %v", ns, s.Spec.TombstoneRetention)
+				cfg.Deleted = time.Now().Unix()
+				configs[ns] = cfg
+			} else {
+				delete(configs, ns)
+			}
+			changed()
+
+		case ns := <-s.rmTombstones:
+			for name, cfg := range configs {
+				if cfg.Deleted != 0 && (ns == "" || ns == name) {
+					log.Printf("Removing config of deleted namespace %v", name)
+					delete(configs, name)
+					changed()
+				}
+			}
 
 		// send configs to consumer
-		case s.getConfigs <- cfgArray(configs):
+		case s.getConfigs <- cfgArray(withDeclared(configs, states)):
 
 		// send states to consumer
 		case s.getStates <- stateArray(states):
 
-		// save configs
-		case <-cfgTick:
-			if configsChanged {
-				err := s.cluster.saveSettings(cfgArray(configs))
+		case s.getBudget <- budget:
+
+		case <-saveTimer:
+			saveTimer = nil
+			if configsChanged && leading && s.leader.isLeader() {
+				save(ctx)
+			}
+
+		// configs changed in the store by others, merged in by saving
+		case <-s.storeChanged:
+			if !s.leader.isLeader() || !leading {
+				reload()
+			} else {
+				save(ctx)
+			}
+
+		// retry failed saves, other replicas follow the configs saved by
+		// the leader
+		case <-cfgTick.C:
+			if !s.leader.isLeader() || !leading {
+				reload()
+			} else {
+				expired := expiredTombstones(configs, time.Now().Unix(), s.Spec.TombstoneRetention)
+				for _, ns := range expired {
+					log.Printf("Config of deleted namespace %v has expired", ns)
+					delete(configs, ns)
+					configsChanged = true
+				}
+				if configsChanged {
+					save(ctx)
+				}
+			}
+			if store, ok := s.store.(statusStore); ok && s.leader.isLeader() {
+				err := store.saveStatus(ctx, scheduleStatuses(configs, states))
 				if err != nil {
-					log.Printf("Unable to save configs: %v", err)
-				} else {
-					configsChanged = false
-					log.Printf("Configs saved")
+					log.Printf("Unable to save schedule status: %v", err)
 				}
 			}
 		}
@@ -79,22 +242,29 @@ func stateArray(states map[string]nsState) []nsState {
 	return result
 }
 
-func loadConfigs(s state) map[string]nsConfig {
+func loadConfigs(ctx context.Context, s state) (map[string]nsConfig, error) {
 	// load existing configs
 	configs := map[string]nsConfig{}
-	loaded, err := s.cluster.getSettings()
+	loaded, err := s.store.load(ctx)
+	if errors.IsNotFound(err) {
+		return configs, nil // nothing saved yet
+	}
 	if err != nil {
 		log.Printf("Unable to load configs from cluster: %v", err)
 	} else {
 		for _, cfg := range loaded {
+			if cfg.Memory == nil {
+				cfg = withMemLimit(cfg, *memLimit(cfg)) // migrate from whole Gi
+			}
 			configs[cfg.Name] = cfg
 		}
 	}
-	return configs
+	return configs, err
 }
 
 // Update the JSON status to be returned to clients
-func updateStatus(configs map[string]nsConfig, states map[string]nsState, clock string) string {
+func updateStatus(configs map[string]nsConfig, states map[string]nsState, clock string,
+	budget int64, queue []string, s state) string {
 	// create sorted list of keys
 	keys := []string{}
 	for key := range states {
@@ -112,25 +282,69 @@ func updateStatus(configs map[string]nsConfig, states map[string]nsState, clock
 				Limit: 10,
 			}
 		}
-		values = append(values, newStatus(key, states[key], cfg))
+		ns := newStatus(key, states[key], cfg, s)
+		ns.QueuePosition = queuePosition(queue, key)
+		values = append(values, ns)
 	}
+	memBudget := newBudget(budget, usedBudget(configs, states, ""))
 	newStatus := status{
-		Clock:      clock,
+		Clock: clock,
+		budgetStatus: budgetStatus{
+			Total:     int(memBudget.Total.Bytes / bytesInGi),
+			Used:      int(memBudget.Used.Bytes / bytesInGi),
+			Available: int(memBudget.Available.Bytes / bytesInGi),
+		},
 		Namespaces: values,
 	}
 	newStatusString, _ := json.Marshal(newStatus)
 	return string(newStatusString)
 }
 
-func newStatus(name string, state nsState, config nsConfig) nsStatus {
-	sinceLastStart := time.Now().Unix() - config.LastStarted
+func newStatus(name string, state nsState, config nsConfig, s state) nsStatus {
+	now := time.Now().In(&s.timeZone)
+	policy := policyFor(config, s.Spec)
+	started := max(config.LastStarted, state.LastScheduled)
+	hour, _ := startHour(config)
+	limitsQuota := int64(0)
+	if limits := memLimitsQuota(config, s.Spec); limits != nil {
+		limitsQuota = limits.Value()
+	}
 	return nsStatus{
 		Name:          name,
 		HasDownQuota:  state.HasDownQuota,
-		CanExtend:     sinceLastStart > 60*60, // running for more than 1hr?
-		MemUsed:       state.MemUsed,
-		MemLimit:      config.Limit,
-		AutoStartHour: config.AutoStartHour,
+		CanExtend:     checkExtend(policy, config, state, now) == nil,
+		MemUsed:       int(state.MemUsed.Value() / bytesInGi),
+		MemLimit:      int(memLimit(config).Value() / bytesInGi),
+		CPURequests:   state.CPURequests,
+		CPULimits:     state.CPULimits,
+		CPURequest:    config.CPURequest,
+		CPULimit:      config.CPULimit,
+		StorageUsed:   state.Storage,
+		Storage:       config.Storage,
+		AutoStartHour: hour,
 		Remaining:     state.Remaining,
+		Phase:         currentPhase(config, state),
+		Priority:      config.Priority,
+		StoppingSoon:  state.StoppingSoon,
+		StopsAt:       state.StopsAt,
+
+		NextScheduledStart: formatOptional(nextScheduled(hour, now), &s.timeZone),
+		LastStarted:        formatOptional(started, &s.timeZone),
+		LastStopped:        formatOptional(config.LastStopped, &s.timeZone),
+		RemainingSeconds:   remainingSeconds(started, now.Unix(), windowOf(config)),
+
+		Memory: memUsage{
+			Used:  newMemAmount(state.MemUsed.Value()),
+			Limit: newMemAmount(memLimit(config).Value()),
+		},
+		MemoryLimits: memUsage{
+			Used:  newMemAmount(state.MemLimitsUsed.Value()),
+			Limit: newMemAmount(limitsQuota),
+		},
+		Conflicts:        state.Conflicts,
+		AnnotationErrors: state.AnnotationErrors,
+
+		Sources:       sources(config),
+		WindowSeconds: windowOf(config),
 	}
 }
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+)
+
+// where namespace configs are kept
+const storeConfigMap = "configmap"
+const storeSchedules = "crd"
+
+var scheduleResource = schema.GroupVersionResource{
+	Group:    "podreaper.io",
+	Version:  "v1alpha1",
+	Resource: "namespaceschedules",
+}
+
+// Loads and saves namespace configs, save returns the configs as saved,
+// which can include changes made by others in the meantime
+type configStore interface {
+	load(ctx context.Context) ([]nsConfig, error)
+	save(ctx context.Context, cfgs []nsConfig) ([]nsConfig, error)
+}
+
+// Stores that can signal changes made by others
+type watchedStore interface {
+	watch(ctx context.Context, resync time.Duration, changed chan<- struct{}) error
+}
+
+// Stores that also record the state of each namespace
+type statusStore interface {
+	saveStatus(ctx context.Context, statuses map[string]scheduleStatus) error
+}
+
+func newConfigStore(spec Specification, cluster k8s) configStore {
+	if spec.ConfigStore == storeSchedules {
+		return newScheduleStore(cluster, spec.Namespace)
+	}
+	return newConfigMapStore(cluster, configMapLocation(spec))
+}
+
+// All configs as one JSON document in a ConfigMap, saved over the version
+// that was last loaded so changes made by others aren't overwritten
+type configMapStore struct {
+	cluster  k8s
+	location types.NamespacedName
+	synced   *syncedSettings
+}
+
+// The configs in the ConfigMap when it was last loaded or saved
+type syncedSettings struct {
+	sync.Mutex
+	resourceVersion string
+	configs         map[string]nsConfig
+	schedules       cache.GenericLister // once watching schedules
+}
+
+func newConfigMapStore(cluster k8s, location types.NamespacedName) configMapStore {
+	return configMapStore{
+		cluster:  cluster,
+		location: location,
+		synced:   &syncedSettings{configs: map[string]nsConfig{}},
+	}
+}
+
+func (c configMapStore) load(ctx context.Context) ([]nsConfig, error) {
+	cfgs, version, err := c.cluster.getSettings(ctx, c.location)
+	if err != nil {
+		return nil, err
+	}
+	c.synced.Lock()
+	defer c.synced.Unlock()
+	c.synced.resourceVersion = version
+	c.synced.configs = configsByName(cfgs)
+	return cfgs, nil
+}
+
+// Save the configs, on a conflict re-read the ConfigMap and merge the
+// namespaces changed here with those changed by others
+func (c configMapStore) save(ctx context.Context, cfgs []nsConfig) ([]nsConfig, error) {
+	c.synced.Lock()
+	defer c.synced.Unlock()
+	saving, version := cfgs, c.synced.resourceVersion
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		saved, err := c.cluster.saveSettings(ctx, c.location, saving, version)
+		if err == nil {
+			version = saved
+			return nil
+		}
+		if !errors.IsConflict(err) {
+			return err
+		}
+		current, currentVersion, loadErr := c.cluster.getSettings(ctx, c.location)
+		if loadErr != nil && !errors.IsNotFound(loadErr) {
+			return loadErr
+		}
+		merged, theirs, ours := mergeConfigs(c.synced.configs, cfgs, current)
+		log.Printf("Configs changed since loaded, merged changes to %v with changes here to %v", theirs, ours)
+		saving, version = merged, currentVersion
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.synced.resourceVersion = version
+	c.synced.configs = configsByName(saving)
+	return saving, nil
+}
+
+// Three-way merge of the configs changed here since they were synced with
+// the current configs in the cluster, returning the merged configs and the
+// namespaces whose changes came from each side. Namespaces changed on both
+// sides keep the changes made here.
+func mergeConfigs(synced map[string]nsConfig, ours []nsConfig, current []nsConfig) ([]nsConfig, []string, []string) {
+	merged := configsByName(current)
+	mine := configsByName(ours)
+	changedHere, changedThere := []string{}, []string{}
+	for name, cfg := range merged {
+		if old, ok := synced[name]; !ok || !sameJSON(old, cfg) {
+			changedThere = append(changedThere, name)
+		}
+	}
+	for name := range synced {
+		if _, ok := merged[name]; !ok {
+			changedThere = append(changedThere, name) // removed
+		}
+		if _, ok := mine[name]; !ok {
+			delete(merged, name)
+			changedHere = append(changedHere, name)
+		}
+	}
+	for name, cfg := range mine {
+		if old, ok := synced[name]; ok && sameJSON(old, cfg) {
+			continue
+		}
+		merged[name] = cfg
+		changedHere = append(changedHere, name)
+	}
+	sort.Strings(changedHere)
+	sort.Strings(changedThere)
+	result := cfgArray(merged)
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, changedThere, changedHere
+}
+
+func configsByName(cfgs []nsConfig) map[string]nsConfig {
+	result := map[string]nsConfig{}
+	for _, cfg := range cfgs {
+		result[cfg.Name] = cfg
+	}
+	return result
+}
+
+// A cluster scoped NamespaceSchedule resource for each namespace, named
+// after the namespace, with the config as its spec. The schedules are the
+// source of truth, so they can be changed with kubectl or GitOps tools: only
+// the schedules the reaper changed are written, and only the ones it created
+// are deleted.
+type scheduleStore struct {
+	cluster k8s
+	owner   string // namespace of the reaper, as other reapers may share the schedules
+	synced  *syncedSettings
+}
+
+func newScheduleStore(cluster k8s, owner string) scheduleStore {
+	return scheduleStore{cluster: cluster, owner: owner, synced: &syncedSettings{configs: map[string]nsConfig{}}}
+}
+
+func (c scheduleStore) schedules() dynamic.ResourceInterface {
+	return c.cluster.dynamic.Resource(scheduleResource)
+}
+
+// Watch the schedules, signalling any change so it can be merged in. Reads
+// come from the informer cache once it has synced.
+func (c scheduleStore) watch(ctx context.Context, resync time.Duration, changed chan<- struct{}) error {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(c.cluster.dynamic, resync)
+	informer := factory.ForResource(scheduleResource)
+	signal := func() {
+		select {
+		case changed <- struct{}{}:
+		default: // already signalled
+		}
+	}
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { signal() },
+		UpdateFunc: func(interface{}, interface{}) { signal() },
+		DeleteFunc: func(interface{}) { signal() },
+	})
+	factory.Start(ctx.Done())
+	for _, synced := range factory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return fmt.Errorf("unable to sync schedules cache")
+		}
+	}
+	c.synced.Lock()
+	defer c.synced.Unlock()
+	c.synced.schedules = informer.Lister()
+	return nil
+}
+
+// The current schedules, from the cache when watching
+func (c scheduleStore) list(ctx context.Context) ([]unstructured.Unstructured, error) {
+	if c.synced.schedules != nil {
+		objects, err := c.synced.schedules.List(labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+		items := []unstructured.Unstructured{}
+		for _, object := range objects {
+			items = append(items, *object.(*unstructured.Unstructured).DeepCopy())
+		}
+		return items, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
+	list, err := c.schedules().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func (c scheduleStore) load(ctx context.Context) ([]nsConfig, error) {
+	c.synced.Lock()
+	defer c.synced.Unlock()
+	items, err := c.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cfgs := schedulesConfigs(items)
+	c.synced.configs = configsByName(cfgs)
+	return cfgs, nil
+}
+
+func schedulesConfigs(items []unstructured.Unstructured) []nsConfig {
+	cfgs := []nsConfig{}
+	for _, item := range items {
+		cfg, err := scheduleConfig(item)
+		if err != nil {
+			log.Printf("Ignoring invalid schedule %v: %v", item.GetName(), err)
+			continue
+		}
+		cfgs = append(cfgs, cfg)
+	}
+	return cfgs
+}
+
+// Write the schedules changed here since they were last loaded or saved,
+// and merge in those changed by others, returning the merged configs
+func (c scheduleStore) save(ctx context.Context, cfgs []nsConfig) ([]nsConfig, error) {
+	c.synced.Lock()
+	defer c.synced.Unlock()
+	items, err := c.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	existing := map[string]unstructured.Unstructured{}
+	for _, item := range items {
+		existing[item.GetName()] = item
+	}
+	current := schedulesConfigs(items)
+	merged, theirs, ours := mergeConfigs(c.synced.configs, cfgs, current)
+	result := configsByName(merged)
+	for _, name := range ours {
+		cfg, keep := result[name]
+		item, exists := existing[name]
+		switch {
+		case keep:
+			err = c.write(ctx, cfg, item, exists)
+		case exists && item.GetLabels()[ownerLabel] != c.owner:
+			result[name], _ = scheduleConfig(item) // not created by this reaper
+		case exists:
+			err = c.schedules().Delete(ctx, name, metav1.DeleteOptions{})
+			if errors.IsNotFound(err) {
+				err = nil
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to save schedule %v: %v", name, err)
+		}
+	}
+	if len(theirs) > 0 {
+		log.Printf("Merged changes to schedules %v", theirs)
+	}
+	saved := cfgArray(result)
+	c.synced.configs = result
+	return saved, nil
+}
+
+// Create or update the spec of a schedule, over the version it was read at
+// and again over the latest version if it has changed since
+func (c scheduleStore) write(ctx context.Context, cfg nsConfig, item unstructured.Unstructured, exists bool) error {
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
+	spec, err := scheduleSpec(cfg)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		schedule := &unstructured.Unstructured{}
+		schedule.SetGroupVersionKind(scheduleResource.GroupVersion().WithKind("NamespaceSchedule"))
+		schedule.SetName(cfg.Name)
+		schedule.SetLabels(map[string]string{managedByLabel: managedBy, ownerLabel: c.owner})
+		schedule.Object["spec"] = spec
+		created, err := c.schedules().Create(ctx, schedule, metav1.CreateOptions{})
+		if err != nil {
+			return err
+		}
+		return c.writeState(ctx, *created, scheduleStateOf(cfg))
+	}
+	item = *item.DeepCopy()
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if sameJSON(item.Object["spec"], spec) {
+			return nil
+		}
+		item.Object["spec"] = spec
+		updated, err := c.schedules().Update(ctx, &item, metav1.UpdateOptions{})
+		if err == nil {
+			item = *updated
+		} else if errors.IsConflict(err) {
+			latest, getErr := c.schedules().Get(ctx, cfg.Name, metav1.GetOptions{})
+			if getErr != nil {
+				return getErr
+			}
+			item = *latest
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return c.writeState(ctx, item, scheduleStateOf(cfg))
+}
+
+// Update the state kept by the reaper in the status of a schedule, which
+// changes with every start, stop or extend
+func (c scheduleStore) writeState(ctx context.Context, item unstructured.Unstructured, state scheduleState) error {
+	value, err := toMap(state)
+	if err != nil {
+		return err
+	}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		status, _ := item.Object["status"].(map[string]interface{})
+		if sameJSON(status["state"], value) || (status["state"] == nil && len(value) == 0) {
+			return nil
+		}
+		if status == nil {
+			status = map[string]interface{}{}
+		}
+		status["state"] = value
+		item.Object["status"] = status
+		_, err := c.schedules().UpdateStatus(ctx, &item, metav1.UpdateOptions{})
+		if errors.IsConflict(err) {
+			latest, getErr := c.schedules().Get(ctx, item.GetName(), metav1.GetOptions{})
+			if getErr != nil {
+				return getErr
+			}
+			item = *latest
+		}
+		return err
+	})
+}
+
+// Update the status of schedules that have changed
+func (c scheduleStore) saveStatus(ctx context.Context, statuses map[string]scheduleStatus) error {
+	ctx, cancel := context.WithTimeout(ctx, apiTimeout)
+	defer cancel()
+	list, err := c.schedules().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, item := range list.Items {
+		st, ok := statuses[item.GetName()]
+		if !ok {
+			continue
+		}
+		status, err := toMap(st)
+		if err != nil {
+			return err
+		}
+		if current, ok := item.Object["status"].(map[string]interface{}); ok && current["state"] != nil {
+			status["state"] = current["state"] // written with the spec
+		}
+		if sameJSON(item.Object["status"], status) {
+			continue
+		}
+		item.Object["status"] = status
+		if _, err := c.schedules().UpdateStatus(ctx, &item, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("unable to update status of schedule %v: %v", item.GetName(), err)
+		}
+	}
+	return nil
+}
+
+func scheduleStatuses(configs map[string]nsConfig, states map[string]nsState) map[string]scheduleStatus {
+	statuses := map[string]scheduleStatus{}
+	for name, state := range states {
+		statuses[name] = scheduleStatus{
+			Phase:        currentPhase(configs[name], state),
+			HasDownQuota: state.HasDownQuota,
+			MemUsed:      state.MemUsed.String(),
+			CPURequests:  state.CPURequests,
+			CPULimits:    state.CPULimits,
+			Remaining:    state.Remaining,
+			StoppingSoon: state.StoppingSoon,
+			StopsAt:      state.StopsAt,
+			Conflicts:    state.Conflicts,
+		}
+	}
+	return statuses
+}
+
+// Copy configs from the ConfigMap to schedules if that hasn't been done
+// before, and there aren't any schedules already
+func migrateConfigs(ctx context.Context, from configMapStore, to scheduleStore) error {
+	cm, err := from.cluster.getConfigMap(ctx, from.location)
+	if errors.IsNotFound(err) {
+		return nil // nothing to migrate
+	}
+	if err != nil {
+		return err
+	}
+	if _, ok := cm.Annotations[migratedAnnotation]; ok {
+		return nil
+	}
+	existing, err := to.load(ctx)
+	if err != nil {
+		return err
+	}
+	if len(existing) == 0 {
+		cfgs, err := fromJSON(cm.Data["config"])
+		if err != nil {
+			return err
+		}
+		if _, err := to.save(ctx, cfgs); err != nil {
+			return err
+		}
+		log.Printf("Migrated %v configs from ConfigMap to schedules", len(cfgs))
+	}
+	return from.cluster.annotateConfigMap(ctx, from.location, migratedAnnotation, formatTime(time.Now().Unix(), time.UTC))
+}
+
+// The config of a schedule, with the settings from its spec and the state
+// from its status. Schedules from older versions have the state in the spec.
+func scheduleConfig(item unstructured.Unstructured) (nsConfig, error) {
+	cfg := nsConfig{}
+	spec, _ := item.Object["spec"].(map[string]interface{})
+	data, err := json.Marshal(spec)
+	if err == nil {
+		err = json.Unmarshal(data, &cfg)
+	}
+	cfg.Name = item.GetName()
+	if state, ok, _ := unstructured.NestedMap(item.Object, "status", "state"); ok && err == nil {
+		var st scheduleState
+		if data, err = json.Marshal(state); err == nil {
+			err = json.Unmarshal(data, &st)
+		}
+		cfg.LastStarted, cfg.LastStopped = st.LastStarted, st.LastStopped
+		cfg.Phase, cfg.PhaseChanged = st.Phase, st.PhaseChanged
+		cfg.ExtendDay, cfg.Extends = st.ExtendDay, st.Extends
+		cfg.Deleted = st.Deleted
+	}
+	return cfg, err
+}
+
+// The settings of a config as a schedule spec, without the name which is
+// the schedule's, or the state kept by the reaper
+func scheduleSpec(cfg nsConfig) (map[string]interface{}, error) {
+	spec, err := toMap(settingsOf(cfg))
+	delete(spec, "name")
+	delete(spec, "lastStarted")
+	return spec, err
+}
+
+// The state of a config kept in the status of its schedule
+func scheduleStateOf(cfg nsConfig) scheduleState {
+	return scheduleState{
+		LastStarted:  cfg.LastStarted,
+		LastStopped:  cfg.LastStopped,
+		Phase:        cfg.Phase,
+		PhaseChanged: cfg.PhaseChanged,
+		ExtendDay:    cfg.ExtendDay,
+		Extends:      cfg.Extends,
+		Deleted:      cfg.Deleted,
+	}
+}
+
+// Generic JSON form of a value, as used by unstructured objects
+func toMap(v interface{}) (map[string]interface{}, error) {
+	result := map[string]interface{}{}
+	data, err := json.Marshal(v)
+	if err == nil {
+		err = json.Unmarshal(data, &result)
+	}
+	return result, err
+}
+
+// Compare values by their JSON, since numbers may be int64 or float64
+func sameJSON(a interface{}, b interface{}) bool {
+	aJSON, aErr := json.Marshal(a)
+	bJSON, bErr := json.Marshal(b)
+	return aErr == nil && bErr == nil && string(aJSON) == string(bJSON)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// Configs of deleted namespaces, kept until they expire in case the
+// namespace is created again
+func tombstones(cfgs []nsConfig, retention time.Duration, zone *time.Location) []tombstone {
+	result := []tombstone{}
+	for _, cfg := range cfgs {
+		if cfg.Deleted == 0 {
+			continue
+		}
+		result = append(result, tombstone{
+			Namespace: cfg.Name,
+			Deleted:   formatTime(cfg.Deleted, zone),
+			Expires:   formatTime(cfg.Deleted+int64(retention.Seconds()), zone),
+			Config:    settingsOf(cfg),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Namespace < result[j].Namespace })
+	return result
+}
+
+// Namespaces whose configs have been kept for longer than the retention
+func expiredTombstones(configs map[string]nsConfig, now int64, retention time.Duration) []string {
+	result := []string{}
+	for name, cfg := range configs {
+		if cfg.Deleted != 0 && now-cfg.Deleted >= int64(retention.Seconds()) {
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
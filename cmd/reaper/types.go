@@ -1,6 +1,11 @@
 package main
 
-import "time"
+import (
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
 
 /*
 Specification contains default configuration for this app
@@ -14,37 +19,185 @@ type Specification struct {
 	CorsOrigins       []string `env:"CORS_ORIGINS,default=http://localhost:3000"`
 	InCluster         bool     `env:"IN_CLUSTER,default=false"`
 	StaticFiles       string   `env:"STATIC_FILES,default="`
+	RecreatePods      bool     `env:"RECREATE_PODS,default=false"`
+	SoftStop          bool     `env:"SOFT_STOP,default=false"`
+	MinMemLimit       int      `env:"MIN_MEM_LIMIT,default=10"`       // Gi
+	MaxMemLimit       int      `env:"MAX_MEM_LIMIT,default=100"`      // Gi
+	MemBudget         int      `env:"MEM_BUDGET,default=0"`           // Gi, zero to use node allocatable memory
+	QuotaMode         string   `env:"QUOTA_MODE,default=replace"`     // replace or apply
+	ConfigStore       string   `env:"CONFIG_STORE,default=configmap"` // configmap or crd
+	MemLimitRatio     float64  `env:"MEM_LIMIT_RATIO,default=0"`      // limits.memory quota as a ratio of requests, zero for none
+
+	// leader election for running multiple replicas
+	LeaderElection bool   `env:"LEADER_ELECTION,default=false"`
+	LeaseName      string `env:"LEASE_NAME,default=pod-reaper"`
+	LeaseNamespace string `env:"LEASE_NAMESPACE,default="` // reaper's namespace if not set
+	PodIP          string `env:"POD_IP,default="`          // address of this replica, hostname if not set
+
+	// which wins when a setting is both set in the UI and annotated on the
+	// namespace, annotations or ui
+	AnnotationPrecedence string `env:"ANNOTATION_PRECEDENCE,default=annotations"`
+
+	// where configs are saved, by default in the namespace the reaper runs in,
+	// which is read from the service account if not set
+	Namespace          string `env:"POD_NAMESPACE,default="`
+	ConfigMapName      string `env:"CONFIG_MAP_NAME,default=podreaper-goconfig"`
+	ConfigMapNamespace string `env:"CONFIG_MAP_NAMESPACE,default="` // reaper's namespace if not set
+	HistorySize        int    `env:"HISTORY_SIZE,default=20"`       // config revisions kept, zero for none
+
+	// how long configs of deleted namespaces are kept, zero to remove them
+	TombstoneRetention time.Duration `env:"TOMBSTONE_RETENTION,default=168h"`
+
+	// extend policy, can be overridden per namespace
+	ExtendMinSinceStart time.Duration `env:"EXTEND_MIN_SINCE_START,default=1h"`
+	ExtendMaxRemaining  time.Duration `env:"EXTEND_MAX_REMAINING,default=0s"` // zero for no maximum
+	ExtendMaxPerDay     int           `env:"EXTEND_MAX_PER_DAY,default=0"`    // zero for unlimited
+	ExtendStopped       bool          `env:"EXTEND_STOPPED,default=true"`
 
 	// timings
-	NamespaceTick  time.Duration `env:"NAMESPACE_TICK,default=11s"`
-	NamespacesTick time.Duration `env:"NAMESPACES_TICK,default=17s"`
-	RangerTick     time.Duration `env:"RANGER_TICK,default=41s"`
-	ClockTick      time.Duration `env:"CLOCK_TICK,default=13s"`
-	ConfigTick     time.Duration `env:"CONFIG_TICK,default=17s"`
-	ReaperTick     time.Duration `env:"REAPER_TICK,default=29s"`
+	NamespaceTick time.Duration `env:"NAMESPACE_TICK,default=11s"`
+	ResyncPeriod  time.Duration `env:"RESYNC_PERIOD,default=5m"` // informer resync
+	ClockTick     time.Duration `env:"CLOCK_TICK,default=13s"`
+	ConfigTick    time.Duration `env:"CONFIG_TICK,default=17s"`
+	ReaperTick    time.Duration `env:"REAPER_TICK,default=29s"`
+	BudgetTick    time.Duration `env:"BUDGET_TICK,default=61s"`
+	HardStopDelay time.Duration `env:"HARD_STOP_DELAY,default=15m"`
+	WarningPeriod time.Duration `env:"WARNING_PERIOD,default=30m"`
+	SaveDelay     time.Duration `env:"SAVE_DELAY,default=1s"` // changes made within this are saved together
+
+	// time allowed to finish requests and save configs when stopping
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT,default=20s"`
 }
 
 // This is the status displayed by the UI
 type status struct {
-	Clock      string     `json:"clock"`
+	Clock string `json:"clock"`
+	budgetStatus
 	Namespaces []nsStatus `json:"namespaces"`
 }
 
+// Cluster memory budget in the status, in whole Gi
+type budgetStatus struct {
+	Total     int `json:"memBudget"`
+	Used      int `json:"memBudgetUsed"`
+	Available int `json:"memBudgetAvailable"`
+}
+
+// Cluster memory budget shared by running namespaces
+type memBudget struct {
+	Total     memAmount `json:"total"`
+	Used      memAmount `json:"used"`
+	Available memAmount `json:"available"`
+}
+
+// Memory used and limit of a namespace
+type memUsage struct {
+	Used  memAmount `json:"used"`
+	Limit memAmount `json:"limit"`
+}
+
+// Amount of memory in bytes, and formatted for display
+type memAmount struct {
+	Bytes     int64  `json:"bytes"`
+	Formatted string `json:"formatted"`
+}
+
 // Namespace settings configured via the UI
 type nsConfig struct {
 	Name          string `json:"name"`
 	AutoStartHour *int   `json:"autoStartHour"`
 	LastStarted   int64  `json:"lastStarted"`
-	Limit         int    `json:"limit"`
+	Limit         int    `json:"limit"`                // whole Gi, replaced by memory
+	CPURequest    int    `json:"cpuRequest,omitempty"` // millicores, zero for no quota
+	CPULimit      int    `json:"cpuLimit,omitempty"`   // millicores, zero for no quota
+	Priority      int    `json:"priority,omitempty"`   // higher starts first when queued
+	Phase         string `json:"phase,omitempty"`
+	PhaseChanged  int64  `json:"phaseChanged,omitempty"`
+	LastStopped   int64  `json:"lastStopped,omitempty"`
+	Deleted       int64  `json:"deleted,omitempty"` // when the namespace was deleted, kept until it expires
+
+	Storage      *storageConfig    `json:"storage,omitempty"`
+	LimitRange   *limitRangeConfig `json:"limitRange,omitempty"`
+	ExtendPolicy *extendPolicy     `json:"extendPolicy,omitempty"`
+	ExtendDay    string            `json:"extendDay,omitempty"` // day the extends were counted
+	Extends      int               `json:"extends,omitempty"`
+
+	// memory limit with sub-Gi precision, this is the requests.memory quota
+	Memory *resource.Quantity `json:"memory,omitempty"`
+
+	// limits.memory quota, either set or as a ratio of the requests quota
+	MemLimits     *resource.Quantity `json:"memLimits,omitempty"`
+	MemLimitRatio *float64           `json:"memLimitRatio,omitempty"` // overrides the default ratio
+
+	// settings declared by namespace annotations, never saved
+	Declared *declaredConfig `json:"-"`
+}
+
+// Storage quota values, anything not set isn't limited
+type storageConfig struct {
+	Requests *resource.Quantity           `json:"requests,omitempty"` // total requested storage
+	Claims   int                          `json:"claims,omitempty"`   // number of persistent volume claims
+	Classes  map[string]resource.Quantity `json:"classes,omitempty"`  // requested storage per storage class
+}
+
+// Container limit range values, any not set use the defaults
+type limitRangeConfig struct {
+	DefaultRequest v1.ResourceList `json:"defaultRequest,omitempty"`
+	Default        v1.ResourceList `json:"default,omitempty"`
+	Min            v1.ResourceList `json:"min,omitempty"`
+	Max            v1.ResourceList `json:"max,omitempty"`
+}
+
+// Rules for when a namespace can be extended, nil values use the defaults
+type extendPolicy struct {
+	MinSinceStart *int64 `json:"minSinceStart,omitempty"` // seconds since last start
+	MaxRemaining  *int64 `json:"maxRemaining,omitempty"`  // seconds remaining, zero for no maximum
+	MaxPerDay     *int   `json:"maxPerDay,omitempty"`     // zero for unlimited
+	AllowStopped  *bool  `json:"allowStopped,omitempty"`
 }
 
 // Namespace data used in backend
 type nsState struct {
 	Name          string
 	HasDownQuota  bool
-	MemUsed       int
+	MemUsed       resource.Quantity // memory requests of pods
+	MemLimitsUsed resource.Quantity // memory limits of pods
+	CPURequests   int               // millicores requested by pods
+	CPULimits     int               // millicore limits of pods
+	Storage       storageUsage
 	Remaining     string
 	LastScheduled int64
+	StoppingSoon  bool           // in the warning period before being stopped
+	StopsAt       string         // RFC3339 stop time, empty if not running
+	Conflicts     []string       // other quotas and limit ranges setting the same limits
+	Declared      declaredConfig // settings from the namespace annotations
+
+	AnnotationErrors []string // annotations ignored as invalid or over budget
+}
+
+// State of a namespace kept by the reaper, in the status of its
+// NamespaceSchedule so the spec only has the settings
+type scheduleState struct {
+	LastStarted  int64  `json:"lastStarted,omitempty"`
+	LastStopped  int64  `json:"lastStopped,omitempty"`
+	Phase        string `json:"phase,omitempty"`
+	PhaseChanged int64  `json:"phaseChanged,omitempty"`
+	ExtendDay    string `json:"extendDay,omitempty"`
+	Extends      int    `json:"extends,omitempty"`
+	Deleted      int64  `json:"deleted,omitempty"`
+}
+
+// Status of a NamespaceSchedule, from the namespace state
+type scheduleStatus struct {
+	Phase        string   `json:"phase"`
+	HasDownQuota bool     `json:"hasDownQuota"`
+	MemUsed      string   `json:"memUsed"`
+	CPURequests  int      `json:"cpuRequests"` // millicores
+	CPULimits    int      `json:"cpuLimits"`
+	Remaining    string   `json:"remaining,omitempty"`
+	StoppingSoon bool     `json:"stoppingSoon,omitempty"`
+	StopsAt      string   `json:"stopsAt,omitempty"`
+	Conflicts    []string `json:"conflicts,omitempty"`
 }
 
 // Namespace data required by UI
@@ -52,10 +205,47 @@ type nsStatus struct {
 	Name          string `json:"name"`
 	HasDownQuota  bool   `json:"hasDownQuota"`
 	CanExtend     bool   `json:"canExtend"`
-	MemUsed       int    `json:"memUsed"`
-	MemLimit      int    `json:"memLimit"`
+	MemUsed       int    `json:"memUsed"`     // whole Gi, see memory for more precision
+	MemLimit      int    `json:"memLimit"`    // whole Gi
+	CPURequests   int    `json:"cpuRequests"` // used, in millicores
+	CPULimits     int    `json:"cpuLimits"`
+	CPURequest    int    `json:"cpuRequest"` // quota, in millicores
+	CPULimit      int    `json:"cpuLimit"`
 	AutoStartHour *int   `json:"autoStartHour"`
 	Remaining     string `json:"remaining"`
+	Phase         string `json:"phase"`
+	Priority      int    `json:"priority"`
+	QueuePosition int    `json:"queuePosition"` // zero if not waiting to start
+	StoppingSoon  bool   `json:"stoppingSoon"`
+	StopsAt       string `json:"stopsAt,omitempty"`
+
+	Memory       memUsage `json:"memory"`       // requests.memory
+	MemoryLimits memUsage `json:"memoryLimits"` // limits.memory, zero limit if not constrained
+	Conflicts    []string `json:"conflicts,omitempty"`
+
+	// annotations that were ignored, as invalid or over the memory budget
+	AnnotationErrors []string `json:"annotationErrors,omitempty"`
+
+	// where startHour, memoryLimit and window came from: default, ui or annotation
+	Sources       map[string]string `json:"sources"`
+	WindowSeconds int64             `json:"windowSeconds"` // length of the uptime window
+
+	// storage is still claimed while the namespace is down
+	StorageUsed storageUsage   `json:"storageUsed"`
+	Storage     *storageConfig `json:"storage,omitempty"`
+
+	// machine readable timings, RFC3339 or empty if unknown
+	NextScheduledStart string `json:"nextScheduledStart,omitempty"`
+	LastStarted        string `json:"lastStarted,omitempty"`
+	LastStopped        string `json:"lastStopped,omitempty"`
+	RemainingSeconds   int64  `json:"remainingSeconds"`
+}
+
+// Storage claimed by persistent volume claims in a namespace
+type storageUsage struct {
+	Requests int64            `json:"requests"` // bytes
+	Claims   int              `json:"claims"`
+	Classes  map[string]int64 `json:"classes"` // bytes per storage class
 }
 
 // POST requests from UI
@@ -63,7 +253,81 @@ type startRequest struct {
 	Namespace string `json:"namespace"`
 	StartHour *int   `json:"startHour"`
 }
-type limitRequest struct {
+type policyRequest struct {
+	Namespace string        `json:"namespace"`
+	Policy    *extendPolicy `json:"policy"`
+}
+type cpuLimitRequest struct {
+	Namespace  string `json:"namespace"`
+	CPURequest int    `json:"cpuRequest"`
+	CPULimit   int    `json:"cpuLimit"`
+}
+type limitRangeRequest struct {
+	Namespace  string            `json:"namespace"`
+	LimitRange *limitRangeConfig `json:"limitRange"`
+}
+
+// Limit range returned to clients, with the values actually used
+// as well as the namespace overrides
+type limitRangeResponse struct {
+	Namespace  string            `json:"namespace"`
+	LimitRange limitRangeConfig  `json:"limitRange"`
+	Overrides  *limitRangeConfig `json:"overrides"`
+}
+
+type storageRequest struct {
+	Namespace string         `json:"namespace"`
+	Storage   *storageConfig `json:"storage"`
+}
+
+type priorityRequest struct {
 	Namespace string `json:"namespace"`
-	Limit     int    `json:"limit"`
+	Priority  int    `json:"priority"`
+}
+
+type limitRequest struct {
+	Namespace string             `json:"namespace"`
+	Limit     *int               `json:"limit,omitempty"`  // whole Gi
+	Memory    *resource.Quantity `json:"memory,omitempty"` // used instead of limit if set
+
+	// limits.memory quota, ratio zero to remove
+	Limits     *resource.Quantity `json:"limits,omitempty"`
+	LimitRatio *float64           `json:"limitRatio,omitempty"`
+}
+
+type rollbackRequest struct {
+	Revision  int    `json:"revision"`
+	Namespace string `json:"namespace,omitempty"` // whole config if not set
+}
+
+// A version of the namespace settings, without the state kept by the reaper
+type revision struct {
+	Revision int        `json:"revision"`
+	Time     string     `json:"time"` // RFC3339
+	Configs  []nsConfig `json:"configs"`
+}
+
+// Change to a namespace config made by importing a document
+type configChange struct {
+	Namespace string    `json:"namespace"`
+	Action    string    `json:"action"`           // add, update or reset to the defaults
+	Before    *nsConfig `json:"before,omitempty"` // settings, nil for new namespaces
+	After     nsConfig  `json:"after"`
+}
+
+type importResponse struct {
+	DryRun  bool           `json:"dryRun"`
+	Changes []configChange `json:"changes"`
+}
+
+// Config kept for a deleted namespace
+type tombstone struct {
+	Namespace string   `json:"namespace"`
+	Deleted   string   `json:"deleted"` // RFC3339
+	Expires   string   `json:"expires"`
+	Config    nsConfig `json:"config"` // settings restored if the namespace is created again
+}
+
+type purgeRequest struct {
+	Namespace string `json:"namespace,omitempty"` // every tombstone if not set
 }
@@ -2,18 +2,22 @@ package main
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
 )
 
-func remainingSeconds(lastStarted int64, now int64) int64 {
-	return max(lastStarted+window*60*60-now, 0)
+func remainingSeconds(lastStarted int64, now int64, window int64) int64 {
+	return max(lastStarted+window-now, 0)
 }
 
 // Turn number of seconds into a readable string
-func remaining(s int64) string {
+func remaining(s int64, window int64) string {
 	m := s / 60
-	h := (m / 60) % window
-	if m <= 0 || m >= window*60 {
+	h := m / 60
+	if m <= 0 || m >= window/60 {
 		return ""
 	}
 	if h > 0 {
@@ -22,6 +26,70 @@ func remaining(s int64) string {
 	return fmt.Sprintf("%dm", m%60)
 }
 
+// Format memory for display without rounding, in Gi when that's exact to
+// one decimal, e.g. "2.5Gi", otherwise like "700Mi" or "2007Mi"
+func formatMemory(bytes int64) string {
+	if bytes >= bytesInGi && bytes*10%bytesInGi == 0 {
+		gi := strconv.FormatFloat(float64(bytes)/bytesInGi, 'f', 1, 64)
+		return strings.TrimSuffix(gi, ".0") + "Gi"
+	}
+	return resource.NewQuantity(bytes, resource.BinarySI).String()
+}
+
+func newMemAmount(bytes int64) memAmount {
+	return memAmount{Bytes: bytes, Formatted: formatMemory(bytes)}
+}
+
+func gibibytes(gi int) resource.Quantity {
+	return *resource.NewQuantity(int64(gi)*bytesInGi, resource.BinarySI)
+}
+
+// Memory limit for a namespace. Configs from before sub-Gi limits
+// only have the limit in whole Gi.
+func memLimit(cfg nsConfig) *resource.Quantity {
+	limit := gibibytes(cfg.Limit)
+	if memLimitSource(cfg) == sourceAnnotation {
+		limit = cfg.Declared.Memory.DeepCopy()
+	} else if cfg.Memory != nil {
+		limit = cfg.Memory.DeepCopy()
+	}
+	return &limit
+}
+
+// The limits.memory quota for a namespace, nil if not constrained
+func memLimitsQuota(cfg nsConfig, spec Specification) *resource.Quantity {
+	if cfg.MemLimits != nil {
+		limits := cfg.MemLimits.DeepCopy()
+		return &limits
+	}
+	ratio := spec.MemLimitRatio
+	if cfg.MemLimitRatio != nil {
+		ratio = *cfg.MemLimitRatio
+	}
+	if ratio <= 0 {
+		return nil
+	}
+	return resource.NewQuantity(int64(float64(memLimit(cfg).Value())*ratio), resource.BinarySI)
+}
+
+// Set the memory limit, keeping the whole Gi value for older versions
+func withMemLimit(cfg nsConfig, limit resource.Quantity) nsConfig {
+	cfg.Memory = &limit
+	cfg.Limit = int(limit.Value() / bytesInGi)
+	return cfg
+}
+
+// Set the limits.memory quota or its ratio to the requests quota,
+// leaving it unchanged if neither is given
+func withMemLimits(cfg nsConfig, limits *resource.Quantity, ratio *float64) nsConfig {
+	if limits != nil {
+		cfg.MemLimits, cfg.MemLimitRatio = limits, nil
+	} else if ratio != nil {
+		cfg.MemLimits, cfg.MemLimitRatio = nil, ratio
+	}
+	return cfg
+}
+
 func max(a, b int64) int64 {
 	if a > b {
 		return a
@@ -52,6 +120,22 @@ func lastScheduled(startHour *int, now time.Time) int64 {
 	return 0
 }
 
+// return the next weekday start after "now", or zero if no start hour
+// has been specified
+func nextScheduled(startHour *int, now time.Time) int64 {
+	if startHour == nil {
+		return 0
+	}
+	next := roundDownHour(withHour(now, *startHour))
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	for isWeekend(next.Weekday()) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next.Unix()
+}
+
 func withHour(t time.Time, hour int) time.Time {
 	return time.Date(t.Year(), t.Month(), t.Day(), hour, t.Minute(), t.Second(), t.Nanosecond(), t.Location())
 }
@@ -79,3 +163,29 @@ func hoursFrom(earlier int64, later int64) int64 {
 func formatTime(value int64, zone *time.Location) string {
 	return time.Unix(value, 0).In(zone).Format(time.RFC3339)
 }
+
+// same as formatTime but empty for unknown (zero) times
+func formatOptional(value int64, zone *time.Location) string {
+	if value == 0 {
+		return ""
+	}
+	return formatTime(value, zone)
+}
+
+// Pointers to items of a list, like those returned by listers
+func pointers[T any](items []T) []*T {
+	result := make([]*T, len(items))
+	for i := range items {
+		result[i] = &items[i]
+	}
+	return result
+}
+
+// Copies of items returned by listers
+func values[T any](items []*T) []T {
+	result := make([]T, len(items))
+	for i, item := range items {
+		result[i] = *item
+	}
+	return result
+}
@@ -1,4 +1,4 @@
-module Main exposing (Namespace, Status, main, msgDecoder, nsDecoder, statusDecoder)
+module Main exposing (Memory, Namespace, Status, main, msgDecoder, nsDecoder, statusDecoder)
 
 import Browser
 import Element
@@ -63,6 +63,7 @@ type ServerState
 
 type alias Model =
     { state : ServerState
+    , error : Maybe String
     , editLimit : Maybe String
     , editStart : Maybe String
     , url : String
@@ -81,6 +82,15 @@ type alias Namespace =
     , memLimit : Int
     , autoStartHour : Maybe Int
     , remaining : Maybe String
+    , memory : Maybe Memory
+    }
+
+
+type alias Memory =
+    { used : Int
+    , usedText : String
+    , limit : Int
+    , limitText : String
     }
 
 
@@ -90,11 +100,42 @@ type alias Status =
     }
 
 
+type RequestError
+    = Failed Http.Error
+    | Rejected String
+
+
+expectStatus : Http.Expect Msg
+expectStatus =
+    Http.expectStringResponse GotUpdate <|
+        \response ->
+            case response of
+                Http.BadUrl_ url ->
+                    Err <| Failed <| BadUrl url
+
+                Http.Timeout_ ->
+                    Err <| Failed Timeout
+
+                Http.NetworkError_ ->
+                    Err <| Failed NetworkError
+
+                Http.BadStatus_ metadata body ->
+                    case D.decodeString errorDecoder body of
+                        Ok message ->
+                            Err <| Rejected message
+
+                        Err _ ->
+                            Err <| Failed <| BadStatus metadata.statusCode
+
+                Http.GoodStatus_ _ body ->
+                    Ok body
+
+
 loadState : String -> Cmd Msg
 loadState url =
     Http.get
         { url = url ++ "status"
-        , expect = Http.expectString GotUpdate
+        , expect = expectStatus
         }
 
 
@@ -108,7 +149,7 @@ extend url namespace =
     Http.post
         { url = url ++ "extend"
         , body = encode namespace |> Http.jsonBody
-        , expect = Http.expectString GotUpdate
+        , expect = expectStatus
         }
 
 
@@ -122,7 +163,7 @@ setLimit url namespace value =
     Http.post
         { url = url ++ "setMemLimit"
         , body = encodeLimit namespace value |> Http.jsonBody
-        , expect = Http.expectString GotUpdate
+        , expect = expectStatus
         }
 
 
@@ -145,7 +186,7 @@ restart url =
     Http.post
         { url = url ++ "restart"
         , body = E.object [] |> Http.jsonBody
-        , expect = Http.expectString GotUpdate
+        , expect = expectStatus
         }
 
 
@@ -154,13 +195,14 @@ setStart url namespace value =
     Http.post
         { url = url ++ "setStartHour"
         , body = encodeStart namespace value |> Http.jsonBody
-        , expect = Http.expectString GotUpdate
+        , expect = expectStatus
         }
 
 
 init : Flags -> ( Model, Cmd Msg )
 init flags =
     ( { state = Loading
+      , error = Nothing
       , editLimit = Nothing
       , editStart = Nothing
       , url = flags
@@ -174,7 +216,7 @@ init flags =
 
 
 type Msg
-    = GotUpdate (Result Http.Error String)
+    = GotUpdate (Result RequestError String)
     | GetUpdate Time.Posix
     | Extend String
     | EditLimit (Maybe String)
@@ -216,26 +258,29 @@ update msg model =
                         Err x ->
                             ( { model | state = LoadFailed <| D.errorToString x }, Cmd.none )
 
-                Err x ->
+                Err (Rejected message) ->
+                    ( { model | error = Just message }, Cmd.none )
+
+                Err (Failed x) ->
                     ( { model | state = LoadFailed <| toString x }, Cmd.none )
 
         GetUpdate _ ->
             ( model, loadState model.url )
 
         Extend namespace ->
-            ( model, extend model.url namespace )
+            ( { model | error = Nothing }, extend model.url namespace )
 
         EditLimit namespace ->
             ( { model | editLimit = namespace }, Cmd.none )
 
         SetLimit namespace limit ->
-            ( model, setLimit model.url namespace limit )
+            ( { model | error = Nothing }, setLimit model.url namespace limit )
 
         EditStart namespace ->
             ( { model | editStart = namespace }, Cmd.none )
 
         SetStart namespace start ->
-            ( model, setStart model.url namespace start )
+            ( { model | error = Nothing }, setStart model.url namespace start )
 
         Restart ->
             ( model, restart model.url )
@@ -300,11 +345,11 @@ nsTable status model =
               , width = fillPortion 3
               , view = showNamespace
               }
-            , { header = el headerAttr <| text "Memory (Gi)"
+            , { header = el headerAttr <| text "Memory"
               , width = fillPortion 1
-              , view = \ns -> el [ getColor ns ] <| text <| String.fromInt ns.memUsed
+              , view = \ns -> el [ getColor ns ] <| text <| memUsedText ns
               }
-            , { header = el headerAttr <| text "Limit (Gi)"
+            , { header = el headerAttr <| text "Limit"
               , width = fillPortion 1
               , view = showLimit model
               }
@@ -457,7 +502,27 @@ showLimit model ns =
             limitEditor ns.name ns.memLimit
 
         else
-            text <| String.fromInt ns.memLimit
+            text <| memLimitText ns
+
+
+memUsedText : Namespace -> String
+memUsedText ns =
+    Maybe.withDefault (String.fromInt ns.memUsed ++ "Gi") <| Maybe.map .usedText ns.memory
+
+
+memLimitText : Namespace -> String
+memLimitText ns =
+    Maybe.withDefault (String.fromInt ns.memLimit ++ "Gi") <| Maybe.map .limitText ns.memory
+
+
+overLimit : Namespace -> Bool
+overLimit ns =
+    case ns.memory of
+        Just memory ->
+            memory.used > memory.limit
+
+        Nothing ->
+            ns.memUsed > ns.memLimit
 
 
 getColor : Namespace -> Attribute msg
@@ -465,7 +530,7 @@ getColor ns =
     if ns.hasDownQuota && ns.memUsed > 0 then
         Font.color red
 
-    else if ns.memUsed > ns.memLimit then
+    else if overLimit ns then
         Font.color red
 
     else if not ns.hasDownQuota then
@@ -525,10 +590,21 @@ title clock =
         ]
 
 
+showError : Maybe String -> Element Msg
+showError error =
+    case error of
+        Nothing ->
+            none
+
+        Just message ->
+            el [ Font.color red, Font.size 16 ] <| text message
+
+
 page : Status -> Model -> Element Msg
 page status model =
     defaultPage
         [ title status.clock
+        , showError model.error
         , nsTable status model
         ]
 
@@ -542,7 +618,7 @@ defaultStyle =
 
 nsDecoder : D.Decoder Namespace
 nsDecoder =
-    D.map7 Namespace
+    D.map8 Namespace
         (D.field "name" D.string)
         (D.field "hasDownQuota" D.bool)
         (D.field "canExtend" D.bool)
@@ -550,6 +626,16 @@ nsDecoder =
         (D.field "memLimit" D.int)
         (D.maybe <| D.field "autoStartHour" D.int)
         (D.maybe <| D.field "remaining" D.string)
+        (D.maybe <| D.field "memory" memoryDecoder)
+
+
+memoryDecoder : D.Decoder Memory
+memoryDecoder =
+    D.map4 Memory
+        (D.at [ "used", "bytes" ] D.int)
+        (D.at [ "used", "formatted" ] D.string)
+        (D.at [ "limit", "bytes" ] D.int)
+        (D.at [ "limit", "formatted" ] D.string)
 
 
 decodeNamespaces : Maybe (List Namespace) -> D.Decoder (List Namespace)
@@ -564,6 +650,11 @@ statusDecoder =
         (D.maybe (D.field "namespaces" <| D.list nsDecoder) |> D.andThen decodeNamespaces)
 
 
+errorDecoder : D.Decoder String
+errorDecoder =
+    D.field "error" D.string
+
+
 msgDecoder : String -> Result D.Error Status
 msgDecoder json =
     D.decodeString statusDecoder json
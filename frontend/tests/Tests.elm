@@ -2,7 +2,7 @@ module Tests exposing (..)
 
 import Expect
 import Json.Decode as D
-import Main exposing (Namespace, Status, msgDecoder, nsDecoder, statusDecoder)
+import Main exposing (Memory, Namespace, Status, msgDecoder, nsDecoder, statusDecoder)
 import Test exposing (..)
 
 
@@ -40,7 +40,11 @@ creepyJson =
             "canExtend": true,
             "memUsed": 6,
             "memLimit": 20,
-            "autoStartHour": 8
+            "autoStartHour": 8,
+            "memory": {
+                "used": { "bytes": 6710886400, "formatted": "6.25Gi" },
+                "limit": { "bytes": 21474836480, "formatted": "20Gi" }
+            }
         }
     """
 
@@ -62,6 +66,7 @@ creepy =
     , memLimit = 20
     , autoStartHour = Just 8
     , remaining = Nothing
+    , memory = Just (Memory 6710886400 "6.25Gi" 21474836480 "20Gi")
     }
 
 
@@ -74,6 +79,7 @@ beautiful =
     , memLimit = 100
     , autoStartHour = Nothing
     , remaining = Nothing
+    , memory = Nothing
     }
 
 
@@ -86,6 +92,7 @@ bold =
     , memLimit = 50
     , autoStartHour = Just 10
     , remaining = Just "6h 14m"
+    , memory = Nothing
     }
 
 